@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+// /admin lets whoever knows ADMIN_TOKEN watch the main contest and change it
+// at runtime: set or roll back counters, pause clicking and replace the
+// greeting on every open page. Each change is written to the admin_audit
+// table. Announcements and pauses last until the server restarts.
+
+const (
+	adminCookie       = "ctb_admin"
+	adminTickInterval = time.Second
+	adminSnapshots    = 10
+	adminAuditEntries = 20
+	maxAnnouncement   = 200
+)
+
+// AuditEntry is one admin action.
+type AuditEntry struct {
+	Ts     int64 // unix seconds
+	Action string
+	Detail string
+	Client string // anonymized client of the admin
+}
+
+// AdminSignals are the inputs of the admin page.
+type AdminSignals struct {
+	Option       string `json:"option"`
+	Count        int64  `json:"count"`
+	Rollback     int64  `json:"rollback"`
+	Announcement string `json:"announcement"`
+}
+
+type AdminPageData struct {
+	Signals string
+	Options []Option
+}
+
+func (app *App) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin", app.adminHandler)
+	mux.HandleFunc("/admin/login", app.adminLogin)
+	mux.HandleFunc("/admin/stream", app.adminOnly(app.adminStream))
+	mux.HandleFunc("/admin/adjust", app.adminOnly(app.adminAdjust))
+	mux.HandleFunc("/admin/rollback", app.adminOnly(app.adminRollback))
+	mux.HandleFunc("/admin/pause", app.adminOnly(app.adminPause))
+	mux.HandleFunc("/admin/message", app.adminOnly(app.adminMessage))
+}
+
+/////////////////////////////////////////////////////////////
+// Sessions
+
+// adminSession is the cookie value of a logged in admin. It is derived from
+// the token, so changing the token logs everyone out.
+func adminSession(token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("click-the-button admin session"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isAdmin accepts the session cookie, or the token itself as a bearer token
+// for scripts.
+func (app *App) isAdmin(r *http.Request) bool {
+	token := app.configuration.adminToken
+	if token == "" {
+		return false
+	}
+	if cookie, err := r.Cookie(adminCookie); err == nil &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(adminSession(token))) == 1 {
+		return true
+	}
+	given := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) == 1
+}
+
+func (app *App) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAdmin(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost && r.URL.Path != "/admin/stream" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (app *App) adminLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := app.configuration.adminToken
+	given := r.PostFormValue("token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		app.audit(r, "login failed", "")
+		w.WriteHeader(http.StatusUnauthorized)
+		if err := site.render(w, "admin-login", true); err != nil {
+			log.Println("Error rendering admin login:", err)
+		}
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookie,
+		Value:    adminSession(token),
+		Path:     "/admin",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	app.audit(r, "login", "")
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+/////////////////////////////////////////////////////////////
+// Page
+
+func (app *App) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !app.isAdmin(r) {
+		if err := site.render(w, "admin-login", false); err != nil {
+			log.Println("Error rendering admin login:", err)
+		}
+		return
+	}
+
+	options := app.configuration.contest.Options
+	signals := app.adminSignals()
+	signals["notice"] = ""
+	signals["option"] = ""
+	if len(options) > 0 {
+		signals["option"] = options[0].ID
+	}
+	signals["count"] = 0
+	signals["rollback"] = 0
+	signals["announcement"] = ""
+	encoded, err := json.Marshal(signals)
+	if err != nil {
+		return
+	}
+	err = site.render(w, "admin", AdminPageData{Signals: string(encoded), Options: options})
+	if err != nil {
+		log.Println("Error rendering admin page:", err)
+	}
+}
+
+// adminSignals are the live values shown on the admin page.
+func (app *App) adminSignals() Signal {
+	return Signal{
+		"counters": app.clicks.Snapshot(),
+		"clients": Signal{
+			"stream": app.streamClients.Load(),
+			"feed":   app.feedClients.Load(),
+			"socket": app.socketClients.Load(),
+		},
+		"paused":  app.paused.Load(),
+		"message": app.message(),
+	}
+}
+
+// adminStream keeps the admin page up to date. The snapshot and audit tables
+// are only sent again when they change.
+func (app *App) adminStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Accel-Buffering", "no")
+	sse := datastar.NewSSE(w, r)
+	ticker := time.NewTicker(adminTickInterval)
+	defer ticker.Stop()
+
+	var lastSnapshots, lastAudit string
+	for {
+		signals := app.adminSignals()
+		if err := sse.MarshalAndMergeSignals(&signals); err != nil {
+			return
+		}
+		if snapshots := app.adminSnapshotRows(); snapshots != lastSnapshots {
+			if err := sse.MergeFragments(snapshots); err != nil {
+				return
+			}
+			lastSnapshots = snapshots
+		}
+		if audit := app.adminAuditRows(); audit != lastAudit {
+			if err := sse.MergeFragments(audit); err != nil {
+				return
+			}
+			lastAudit = audit
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-app.draining:
+			askStreamToReconnect(sse, "/admin/stream")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) adminSnapshotRows() string {
+	now := time.Now().UTC().Unix()
+	points, err := app.db.History(app.slug(), HistoryQuery{From: now - 7*24*3600, Step: 100})
+	if err != nil {
+		log.Println("Error fetching snapshots for admin:", err)
+		return `<tbody id="snapshots"><tr><td>db error</td></tr></tbody>`
+	}
+	points = points[max(len(points)-adminSnapshots, 0):]
+
+	var rows strings.Builder
+	rows.WriteString(`<tbody id="snapshots">`)
+	for i := len(points) - 1; i >= 0; i-- {
+		p := points[i]
+		fmt.Fprintf(&rows, "<tr><td>%s</td>", time.Unix(p.Ts, 0).UTC().Format(time.DateTime))
+		for _, o := range app.configuration.contest.Options {
+			fmt.Fprintf(&rows, "<td>%d</td>", p.Clicks[o.ID])
+		}
+		fmt.Fprintf(&rows, `<td><button data-on-click="$rollback = %d; @post('/admin/rollback')">Roll back</button></td></tr>`, p.Ts)
+	}
+	if len(points) == 0 {
+		rows.WriteString("<tr><td>No snapshots this week.</td></tr>")
+	}
+	rows.WriteString("</tbody>")
+	return rows.String()
+}
+
+func (app *App) adminAuditRows() string {
+	entries, err := app.db.AuditLog(adminAuditEntries)
+	if err != nil {
+		log.Println("Error fetching audit log:", err)
+		return `<ul id="audit"><li>db error</li></ul>`
+	}
+	var rows strings.Builder
+	rows.WriteString(`<ul id="audit">`)
+	for _, e := range entries {
+		fmt.Fprintf(&rows, "<li><small>%s</small> <strong>%s</strong> %s</li>",
+			time.Unix(e.Ts, 0).UTC().Format(time.DateTime), html.EscapeString(e.Action), html.EscapeString(e.Detail))
+	}
+	if len(entries) == 0 {
+		rows.WriteString("<li>Nothing yet.</li>")
+	}
+	rows.WriteString("</ul>")
+	return rows.String()
+}
+
+/////////////////////////////////////////////////////////////
+// Actions
+
+// adminReply answers an admin action with a notice on the admin page.
+func adminReply(w http.ResponseWriter, r *http.Request, notice string) {
+	sse := datastar.NewSSE(w, r)
+	if err := sse.MarshalAndMergeSignals(&Signal{"notice": notice}); err != nil {
+		log.Println("sse error answering admin:", err)
+	}
+}
+
+func (app *App) adminAdjust(w http.ResponseWriter, r *http.Request) {
+	var signals AdminSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		http.Error(w, "invalid signals", http.StatusBadRequest)
+		return
+	}
+	if !app.clicks.Has(signals.Option) || signals.Count < 0 {
+		adminReply(w, r, "Pick an option and a count of 0 or more.")
+		return
+	}
+	if app.clicks.Replicated() {
+		adminReply(w, r, "Replicated counters only grow and can't be set.")
+		return
+	}
+	before := app.clicks.Load(signals.Option)
+	app.clicks.Store(signals.Option, signals.Count)
+	detail := fmt.Sprintf("%s from %d to %d", signals.Option, before, signals.Count)
+	app.audit(r, "adjust", detail)
+	adminReply(w, r, "Set "+detail+app.saveAdminChange())
+}
+
+func (app *App) adminRollback(w http.ResponseWriter, r *http.Request) {
+	var signals AdminSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		http.Error(w, "invalid signals", http.StatusBadRequest)
+		return
+	}
+	if app.clicks.Replicated() {
+		adminReply(w, r, "Replicated counters only grow and can't be rolled back.")
+		return
+	}
+	points, err := app.db.History(app.slug(), HistoryQuery{From: signals.Rollback, To: signals.Rollback})
+	if err != nil || len(points) == 0 {
+		adminReply(w, r, fmt.Sprintf("No snapshot at %d.", signals.Rollback))
+		return
+	}
+	// Options added since the snapshot go back to zero too.
+	counts := make(map[string]int64)
+	for _, option := range app.clicks.Options() {
+		counts[option] = points[0].Clicks[option]
+	}
+	app.clicks.StoreAll(counts)
+	when := time.Unix(signals.Rollback, 0).UTC().Format(time.DateTime)
+	app.audit(r, "rollback", fmt.Sprintf("to %s %v", when, counts))
+	adminReply(w, r, "Rolled back to "+when+app.saveAdminChange())
+}
+
+// saveAdminChange snapshots the counters right away, so a crash doesn't undo
+// an admin's change. It returns a note for the admin when that failed.
+func (app *App) saveAdminChange() string {
+	if err := app.finalSnapshot(time.Now()); err != nil {
+		log.Println("Error saving admin change:", err)
+		return " (not saved yet, the next snapshot will)"
+	}
+	return "."
+}
+
+func (app *App) adminPause(w http.ResponseWriter, r *http.Request) {
+	paused := !app.paused.Load()
+	app.paused.Store(paused)
+	if paused {
+		app.audit(r, "pause", "")
+		adminReply(w, r, "Clicking is paused.")
+		return
+	}
+	app.audit(r, "resume", "")
+	adminReply(w, r, "Clicking is open again.")
+}
+
+// adminMessage replaces $message on every open page. An empty announcement
+// goes back to the greeting.
+func (app *App) adminMessage(w http.ResponseWriter, r *http.Request) {
+	var signals AdminSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		http.Error(w, "invalid signals", http.StatusBadRequest)
+		return
+	}
+	message := strings.TrimSpace(signals.Announcement)
+	if utf8.RuneCountInString(message) > maxAnnouncement {
+		adminReply(w, r, fmt.Sprintf("Announcements are at most %d characters.", maxAnnouncement))
+		return
+	}
+	if message == "" {
+		message = app.configuration.contest.Greeting
+	}
+	app.announcement.Store(&message)
+	app.publishCounters(nil)
+	app.audit(r, "message", message)
+	adminReply(w, r, "Announced.")
+}
+
+func (app *App) audit(r *http.Request, action, detail string) {
+	entry := AuditEntry{
+		Ts:     time.Now().UTC().Unix(),
+		Action: action,
+		Detail: detail,
+		Client: app.configuration.anonymizeClient(app.configuration.clientIP(r)),
+	}
+	log.Println("admin", action, detail)
+	if err := app.db.InsertAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+// ---------- Storage -------------
+
+func insertAudit(db DB, e AuditEntry) error {
+	_, err := db.Exec(`INSERT INTO admin_audit(ts, action, detail, client) VALUES (?,?,?,?)`,
+		e.Ts, e.Action, e.Detail, e.Client)
+	return err
+}
+
+// fetchAuditLog returns the newest entries first.
+func fetchAuditLog(db DB, limit int) ([]AuditEntry, error) {
+	rows, err := db.Query(`SELECT ts, action, detail, client FROM admin_audit ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Ts, &e.Action, &e.Detail, &e.Client); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
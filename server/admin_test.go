@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newAdminApp() *App {
+	app := newTestApp()
+	app.configuration.adminToken = "let-me-in"
+	return app
+}
+
+func adminRequest(app *App, path, signals string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(signals))
+	r.Header.Set("datastar-request", "true")
+	r.AddCookie(&http.Cookie{Name: adminCookie, Value: adminSession(app.configuration.adminToken)})
+	return r
+}
+
+func serveAdmin(app *App, r *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	app.registerAdminRoutes(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestAdminLogin(t *testing.T) {
+	app := newAdminApp()
+	login := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveAdmin(app, r)
+	}
+
+	if rr := login("guess"); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "Wrong token") {
+		t.Fatalf("wrong token: %d", rr.Code)
+	}
+	rr := login("let-me-in")
+	cookies := rr.Result().Cookies()
+	if rr.Code != http.StatusSeeOther || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("login: %d, cookies %v", rr.Code, cookies)
+	}
+
+	page := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	if body := serveAdmin(app, page).Body.String(); !strings.Contains(body, `name="token"`) {
+		t.Fatal("logged out visitors should get the login form")
+	}
+	page.AddCookie(cookies[0])
+	if body := serveAdmin(app, page).Body.String(); !strings.Contains(body, "@get('/admin/stream')") {
+		t.Fatalf("logged in admins should get the console, got %s", body)
+	}
+
+	entries, _ := app.db.AuditLog(10)
+	if len(entries) != 2 || entries[0].Action != "login" || entries[1].Action != "login failed" {
+		t.Fatalf("logins should be audited, got %+v", entries)
+	}
+}
+
+func TestAdminActionsNeedAuth(t *testing.T) {
+	app := newAdminApp()
+	for _, path := range []string{"/admin/stream", "/admin/adjust", "/admin/rollback", "/admin/pause", "/admin/message"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"option":"A","count":9}`))
+		if rr := serveAdmin(app, r); rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a session: want 401, got %d", path, rr.Code)
+		}
+	}
+	r := httptest.NewRequest(http.MethodPost, "/admin/pause", nil)
+	r.Header.Set("Authorization", "Bearer let-me-in")
+	if rr := serveAdmin(app, r); rr.Code != http.StatusOK || !app.paused.Load() {
+		t.Fatalf("bearer token: %d", rr.Code)
+	}
+	if app.clicks.Load("A") != 0 {
+		t.Fatal("refused actions must not change anything")
+	}
+}
+
+func TestAdminAdjustAndRollback(t *testing.T) {
+	app := newAdminApp()
+	app.db.InsertSnapshot("", 1000, map[string]int64{"A": 7}, 0)
+	app.clicks.StoreAll(map[string]int64{"A": 500, "B": 40})
+
+	rr := serveAdmin(app, adminRequest(app, "/admin/adjust", `{"option":"A","count":12}`))
+	if app.clicks.Load("A") != 12 || !strings.Contains(rr.Body.String(), "A from 500 to 12") {
+		t.Fatalf("adjust: A is %d, body %q", app.clicks.Load("A"), rr.Body.String())
+	}
+	if latest, _, _ := app.db.LatestSnapshot(""); latest.Clicks["A"] != 12 {
+		t.Fatalf("the adjustment should be saved right away, latest snapshot %+v", latest)
+	}
+
+	serveAdmin(app, adminRequest(app, "/admin/rollback", `{"rollback":1000}`))
+	if got := app.clicks.Snapshot(); got["A"] != 7 || got["B"] != 0 {
+		t.Fatalf("rollback: got %v", got)
+	}
+	rr = serveAdmin(app, adminRequest(app, "/admin/rollback", `{"rollback":999}`))
+	if !strings.Contains(rr.Body.String(), "No snapshot at 999") {
+		t.Fatalf("rollback to a missing snapshot: %q", rr.Body.String())
+	}
+
+	entries, _ := app.db.AuditLog(10)
+	if len(entries) != 2 || entries[0].Action != "rollback" || entries[1].Detail != "A from 500 to 12" {
+		t.Fatalf("audit log: %+v", entries)
+	}
+}
+
+func TestAdminPauseRefusesClicks(t *testing.T) {
+	app := newAdminApp()
+	serveAdmin(app, adminRequest(app, "/admin/pause", ""))
+
+	rr := httptest.NewRecorder()
+	app.clickHandler(rr, httptest.NewRequest(http.MethodPost, "/click/A", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), pausedNotice) || app.clicks.Load("A") != 0 {
+		t.Fatalf("paused click: %d %q", rr.Code, rr.Body.String())
+	}
+
+	serveAdmin(app, adminRequest(app, "/admin/pause", ""))
+	rr = httptest.NewRecorder()
+	app.clickHandler(rr, httptest.NewRequest(http.MethodPost, "/click/A", nil))
+	if rr.Code != http.StatusOK || app.clicks.Load("A") != 1 {
+		t.Fatalf("resumed click: %d", rr.Code)
+	}
+}
+
+func TestAdminMessageReachesOpenPages(t *testing.T) {
+	app := newAdminApp()
+	sub := app.counterStream.Subscribe()
+	defer app.counterStream.Unsubscribe(sub)
+
+	serveAdmin(app, adminRequest(app, "/admin/message", `{"announcement":"Back in 5 minutes"}`))
+	event := <-sub.C
+	if !strings.Contains(string(event.sse), `"message":"Back in 5 minutes"`) || !strings.Contains(string(event.ws), `"message":"Back in 5 minutes"`) {
+		t.Fatalf("announcement should be pushed, got %q", event.sse)
+	}
+	if app.message() != "Back in 5 minutes" {
+		t.Fatalf("new pages should get the announcement, got %q", app.message())
+	}
+
+	serveAdmin(app, adminRequest(app, "/admin/message", `{"announcement":"  "}`))
+	if app.message() != "hello" {
+		t.Fatalf("an empty announcement restores the greeting, got %q", app.message())
+	}
+}
+
+func TestAdminAnnouncementWithApostrophe(t *testing.T) {
+	app := newAdminApp()
+	serveAdmin(app, adminRequest(app, "/admin/message", `{"announcement":"We're back"}`))
+
+	rr := httptest.NewRecorder()
+	app.homeHandler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if sig := pageSignals(t, rr.Body.String()); sig.Message != "We're back" {
+		t.Fatalf("home page: got %q", sig.Message)
+	}
+
+	page := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	page.AddCookie(&http.Cookie{Name: adminCookie, Value: adminSession(app.configuration.adminToken)})
+	if sig := pageSignals(t, serveAdmin(app, page).Body.String()); sig.Message != "We're back" {
+		t.Fatalf("admin page: got %q", sig.Message)
+	}
+}
@@ -1,4 +1,4 @@
-let fullLabels = [], fullClicksA = [], fullClicksB = [];
+let fullLabels = [], fullClicks = {};   // fullClicks: option id -> counts
 let chart;
 let currentRange = 'all';
 
@@ -10,25 +10,16 @@ const ranges = {                   // range is in ms
   '1w':  7 * 24 * 60 * 60 * 1000,
 };
 
+const historyPoints = 500;         // server buckets history to roughly this many points
+
 async function load() {
-  if (fullLabels.length == 0 && fullClicksA.length == 0 && fullClicksB.length == 0) {
-      const res  = await fetch('metrics/history');
-      const data = await res.json();
-      if (!data) {
-          return
-      }
-      
-      fullLabels = data.map(p => new Date(p.ts * 1000));
-      fullClicksA = data.map(p => p.clicksA);
-      fullClicksB  = data.map(p => p.clicksB);
+  if (fullLabels.length == 0) {
+      (await fetchHistory(rangeParams(currentRange))).forEach(pushPoint);
   }
 
   const es = getEventStream();
   es.addEventListener('point', e => {
-    const p = JSON.parse(e.data);
-    fullLabels.push(new Date(p.ts * 1000));
-    fullClicksA.push(p.clicksA);
-    fullClicksB.push(p.clicksB);
+    pushPoint(JSON.parse(e.data));
 
     if (chart) {
       updateWindow();             // slide window
@@ -36,7 +27,54 @@ async function load() {
     }
   });
   es.onerror = () => console.log('SSE error – browser will retry automatically');
+  es.addEventListener('resync', catchUp);   // server no longer has the points we missed
+
+}
+
+async function fetchHistory(params) {
+  const query = new URLSearchParams({ step: historyPoints, ...params });
+  const res = await fetch('metrics/history?' + query);
+  if (!res.ok) {
+    console.log('history error', res.status, await res.text());
+    return [];
+  }
+  return (await res.json()) || [];
+}
+
+function rangeParams(range) {
+  if (range === 'all') return {};
+  return { from: Math.floor((Date.now() - ranges[range]) / 1000) };
+}
+
+async function catchUp() {
+  if (fullLabels.length == 0) return;
+  (await fetchHistory({ since: lastTs() })).forEach(pushPoint);
+  if (chart) chart.update('none');
+}
 
+function lastTs() {
+  if (fullLabels.length == 0) return 0;
+  return Math.floor(fullLabels[fullLabels.length - 1].getTime() / 1000);
+}
+
+function resetPoints() {
+  fullLabels.length = 0;           // chart datasets hold these arrays, so empty them in place
+  for (const id in fullClicks) fullClicks[id].length = 0;
+}
+
+function pushPoint(p) {
+  const i = fullLabels.length;
+  const time = p.id || p.ts * 1000;   // feed points carry milliseconds
+  if (i > 0 && time <= fullLabels[i - 1].getTime()) return;   // already have it
+  fullLabels.push(new Date(time));
+  for (const id in p.clicks) {
+    if (!fullClicks[id]) {
+      fullClicks[id] = new Array(i).fill(null);   // option added later
+    }
+  }
+  for (const id in fullClicks) {
+    fullClicks[id].push(p.clicks[id] ?? null);
+  }
 }
 
 load() // Occurs on page load
@@ -49,7 +87,10 @@ let es;
 function getEventStream() {
   if (es) return es;
 
-  es = new EventSource('/metrics/feed');
+  // The feed replays points after the last one we have; on reconnects the
+  // browser sends Last-Event-ID instead.
+  const since = lastTs();
+  es = new EventSource('metrics/feed' + (since ? '?since=' + since : ''));
   window.addEventListener('beforeunload', () => es.close());
   return es;
 }
@@ -57,9 +98,9 @@ function getEventStream() {
 
 /* ────────────────── Chart ────────────────── */
 
-function setupChart(){
+function setupChart(series){
   addButtonListeners()
-  createChart()
+  createChart(series)
 }
 
 function addButtonListeners(){
@@ -70,18 +111,28 @@ function addButtonListeners(){
     );
 }
 
-function createChart() {
+function createChart(series) {
   const ctx = document.getElementById('mChart');
   if (chart) chart.destroy();
 
+  const datasets = series.map(s => {
+    if (!fullClicks[s.id]) {
+      fullClicks[s.id] = new Array(fullLabels.length).fill(null);
+    }
+    return {
+      label: s.name,
+      data: fullClicks[s.id],
+      borderColor: s.color,
+      backgroundColor: s.color,
+      borderWidth: 1
+    };
+  });
+
   chart = new Chart(ctx, {
     type: 'line',
     data: {
       labels: fullLabels,
-      datasets: [
-        { label: '🐕 (Dog)', data: fullClicksA, borderWidth: 1 },
-        { label: '🐈 (Cat)',  data: fullClicksB,  borderWidth: 1 }
-      ]
+      datasets: datasets
     },
     options: {
       responsive: true,
@@ -100,8 +151,11 @@ function createChart() {
   });
 }
 
-function setRange(range) {
+async function setRange(range) {
   currentRange = range;
+  const data = await fetchHistory(rangeParams(range));
+  resetPoints();
+  data.forEach(pushPoint);
   updateWindow();
   chart.update('none');
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are named after the UTC time they were taken. Older servers wrote
+// one file per day; those names are still understood so they get pruned too.
+const (
+	backupPrefix       = "backup-"
+	backupSuffix       = ".db"
+	backupLayout       = "2006-01-02T150405Z"
+	legacyBackupLayout = "2006-01-02"
+	backupManifestName = "manifest.json"
+)
+
+type backupFile struct {
+	path     string
+	taken    time.Time
+	verified bool
+}
+
+func backupWithVacuumInto(ctx context.Context, db DB, dir string, now time.Time) (string, error) {
+	filename := filepath.Join(dir, backupPrefix+now.UTC().Format(backupLayout)+backupSuffix)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	// VACUUM INTO refuses to overwrite, which only matters for two backups
+	// in the same second.
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// SQL single quotes are escaped via doubling
+	quoted := strings.ReplaceAll(filename, `'`, `''`)
+
+	_, err := db.ExecContext(ctx, "VACUUM INTO '"+quoted+"'")
+	return filename, err
+}
+
+// takeBackup writes a backup, verifies it, ships it to the sink if there is
+// one and prunes old ones. Every outcome is logged and counted in telemetry
+// so a failing backup job shows up on /metrics; a backup that fails
+// verification counts as a failed backup and is not shipped.
+func takeBackup(db DB, dir string, config BackupConfig, sink BackupSink) error {
+	filename, err := writeVerifiedBackup(db, dir, time.Now())
+	telemetry.recordBackup(err)
+	if err != nil {
+		log.Println("Error taking backup:", err)
+		return err
+	}
+
+	if sink != nil {
+		removed, err := shipBackup(context.Background(), sink, filename, config)
+		telemetry.recordUpload(err)
+		if err != nil {
+			log.Println("Error shipping backup:", err)
+		} else {
+			log.Println("backup shipped to", sink, "pruned", len(removed), "old copies there")
+		}
+	}
+
+	pruned, err := pruneBackups(dir, config)
+	telemetry.backupsPruned.Add(int64(len(pruned)))
+	if err != nil {
+		telemetry.pruneErrors.Add(1)
+		log.Println("Error pruning backups:", err)
+		return err
+	}
+	if len(pruned) > 0 {
+		log.Println("pruned", len(pruned), "old backups")
+	}
+	return nil
+}
+
+// writeVerifiedBackup takes a backup and records the result of verifying it
+// in the manifest, whether or not it passed.
+func writeVerifiedBackup(db DB, dir string, now time.Time) (string, error) {
+	before, _, err := fetchLatestSnapshot(db, "")
+	if err != nil {
+		return "", err
+	}
+	filename, err := backupWithVacuumInto(context.Background(), db, dir, now)
+	if err != nil {
+		return "", err
+	}
+
+	record, verifyErr := verifyBackup(db, filename, before.Ts)
+	record.Taken = now.UTC()
+	if verifyErr != nil {
+		record.Error = verifyErr.Error()
+	}
+	if err := updateManifest(dir, func(m BackupManifest) { m[record.File] = record }); err != nil {
+		return "", errors.Join(verifyErr, fmt.Errorf("write manifest: %w", err))
+	}
+	if verifyErr != nil {
+		return "", fmt.Errorf("verify %s: %w", filename, verifyErr)
+	}
+	log.Printf("backup written to %s (%d bytes, %d snapshots, verified)", filename, record.Size, record.Snapshots)
+	return filename, nil
+}
+
+func (app *App) backupPeriodically() {
+	config := app.configuration.backups
+	if config.interval <= 0 {
+		return
+	}
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		ticker := time.NewTicker(config.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			app.db.Backup(app.configuration.backupDir(), config, app.backupSink)
+		}
+	}()
+}
+
+// ---------- Verification -------------
+
+// BackupRecord is what the manifest knows about one backup file.
+type BackupRecord struct {
+	File      string    `json:"file"`
+	Taken     time.Time `json:"taken"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Snapshots int64     `json:"snapshots"`
+	Verified  bool      `json:"verified"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// BackupManifest is kept as manifest.json next to the backups, keyed by file
+// name. Backups missing from it were never verified.
+type BackupManifest map[string]BackupRecord
+
+// verifyBackup reopens a backup read-only and checks that it is intact and
+// holds the live database's latest snapshot of the main contest, which is
+// what the counters are restored from. liveLatest is the newest snapshot
+// before the backup was taken; one written while it ran is fine as long as
+// the live database agrees with the backup about it.
+func verifyBackup(live DB, path string, liveLatest int64) (BackupRecord, error) {
+	record := BackupRecord{File: filepath.Base(path)}
+	size, sum, err := checksumFile(path)
+	if err != nil {
+		return record, err
+	}
+	record.Size, record.SHA256 = size, sum
+
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return record, err
+	}
+	defer conn.Close()
+	backup := DB{DB: conn}
+
+	if err := checkIntegrity(conn); err != nil {
+		return record, err
+	}
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM ` + allSnapshots).Scan(&record.Snapshots); err != nil {
+		return record, err
+	}
+
+	latest, _, err := fetchLatestSnapshot(backup, "")
+	if err != nil {
+		return record, err
+	}
+	if latest.Ts < liveLatest {
+		return record, fmt.Errorf("latest snapshot is %d, live database has %d", latest.Ts, liveLatest)
+	}
+	if latest.Ts != 0 {
+		want, err := fetchSnapshotClicks(live, "", latest.Ts)
+		if err != nil {
+			return record, err
+		}
+		if !maps.Equal(want, latest.Clicks) {
+			return record, fmt.Errorf("snapshot %d holds %v, live database has %v", latest.Ts, latest.Clicks, want)
+		}
+	}
+
+	record.Verified = true
+	return record, nil
+}
+
+func checksumFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func loadManifest(dir string) (BackupManifest, error) {
+	manifest := BackupManifest{}
+	raw, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", backupManifestName, err)
+	}
+	return manifest, nil
+}
+
+// updateManifest applies change to the manifest and writes it back through a
+// temporary file, so a crash never leaves half a manifest behind.
+func updateManifest(dir string, change func(BackupManifest)) error {
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return err
+	}
+	change(manifest)
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, backupManifestName)
+	if err := os.WriteFile(path+".tmp", raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ---------- Retention -------------
+
+// listBackups returns the backups in dir, newest first. Files that don't look
+// like backups are left alone.
+func listBackups(dir string) ([]backupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if taken, ok := parseBackupName(entry.Name()); ok {
+			backups = append(backups, backupFile{path: filepath.Join(dir, entry.Name()), taken: taken})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].taken.After(backups[j].taken) })
+	return backups, nil
+}
+
+func parseBackupName(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, backupPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	stamp, ok = strings.CutSuffix(stamp, backupSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{backupLayout, legacyBackupLayout} {
+		if t, err := time.Parse(layout, stamp); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// backupsToPrune applies a grandfather-father-son policy to backups, which
+// must be sorted newest first: the newest backup of each of the last
+// keepHourly hours, keepDaily days and keepWeekly ISO weeks survives, as do
+// the newest backup overall and the newest verified one, however old. With
+// every count at zero nothing is pruned.
+func backupsToPrune(backups []backupFile, config BackupConfig) []backupFile {
+	if config.keepHourly <= 0 && config.keepDaily <= 0 && config.keepWeekly <= 0 {
+		return nil
+	}
+	rules := []struct {
+		keep   int
+		bucket func(time.Time) string
+	}{
+		{config.keepHourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{config.keepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{config.keepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+	}
+
+	kept := make(map[string]bool)
+	if len(backups) > 0 {
+		kept[backups[0].path] = true
+	}
+	for _, b := range backups {
+		if b.verified {
+			kept[b.path] = true
+			break
+		}
+	}
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			key := rule.bucket(b.taken.UTC())
+			if seen[key] {
+				continue
+			}
+			if len(seen) >= rule.keep {
+				break
+			}
+			seen[key] = true
+			kept[b.path] = true
+		}
+	}
+
+	var prune []backupFile
+	for _, b := range backups {
+		if !kept[b.path] {
+			prune = append(prune, b)
+		}
+	}
+	return prune
+}
+
+// pruneBackups deletes the backups in dir that the retention policy no longer
+// keeps, drops them from the manifest and returns their paths. The policy
+// counts buckets that have backups rather than calendar time, so a server
+// that was down for a week does not lose its older backups on restart.
+func pruneBackups(dir string, config BackupConfig) ([]string, error) {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range backups {
+		backups[i].verified = manifest[filepath.Base(backups[i].path)].Verified
+	}
+
+	var removed []string
+	listed := false
+	for _, b := range backupsToPrune(backups, config) {
+		if err = os.Remove(b.path); err != nil {
+			break
+		}
+		removed = append(removed, b.path)
+		_, inManifest := manifest[filepath.Base(b.path)]
+		listed = listed || inManifest
+	}
+	if !listed {
+		return removed, err
+	}
+	manifestErr := updateManifest(dir, func(m BackupManifest) {
+		for _, path := range removed {
+			delete(m, filepath.Base(path))
+		}
+	})
+	return removed, errors.Join(err, manifestErr)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func touchBackups(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func remainingFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBackupWritesTimestampedCopy(t *testing.T) {
+	db := newTestDB(t)
+	if err := insertSnapshotAt(db, "", 100, map[string]int64{"A": 7}, 1); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "backups")
+	now := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	filename, err := backupWithVacuumInto(context.Background(), db, dir, now)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if want := filepath.Join(dir, "backup-2025-03-04T050607Z.db"); filename != want {
+		t.Fatalf("filename: want %s, got %s", want, filename)
+	}
+
+	copy, err := openDB(filename)
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer copy.Close()
+	clicks, _ := fetchMostRecentSnapshot(copy, "")
+	if clicks["A"] != 7 {
+		t.Fatalf("backup should hold the snapshot, got %v", clicks)
+	}
+}
+
+func TestPruneBackupsKeepsHourlyDailyWeekly(t *testing.T) {
+	dir := t.TempDir()
+	touchBackups(t, dir,
+		"backup-2025-03-10T123000Z.db", // newest, Monday
+		"backup-2025-03-10T120000Z.db", // same hour as the newest, dropped
+		"backup-2025-03-10T110000Z.db", // second hour
+		"backup-2025-03-10T100000Z.db", // third hour, dropped
+		"backup-2025-03-09T230000Z.db", // newest of Sunday
+		"backup-2025-03-09T010000Z.db", // older Sunday, dropped
+		"backup-2025-03-08T120000Z.db", // third day, dropped
+		"backup-2025-03-01.db",         // legacy name, two weeks back
+		"backup-2025-02-20.db",         // three weeks back, dropped
+		"notes.txt",                    // not a backup
+	)
+
+	removed, err := pruneBackups(dir, BackupConfig{keepHourly: 2, keepDaily: 2, keepWeekly: 3})
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(removed) != 5 {
+		t.Errorf("removed: want 5, got %v", removed)
+	}
+	want := []string{
+		"backup-2025-03-01.db",
+		"backup-2025-03-09T230000Z.db",
+		"backup-2025-03-10T110000Z.db",
+		"backup-2025-03-10T123000Z.db",
+		"notes.txt",
+	}
+	got := remainingFiles(t, dir)
+	if len(got) != len(want) {
+		t.Fatalf("remaining: want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("remaining: want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestPruneBackupsDisabledOrEmpty(t *testing.T) {
+	dir := t.TempDir()
+	touchBackups(t, dir, "backup-2025-03-10T120000Z.db", "backup-2025-03-01.db")
+
+	if removed, err := pruneBackups(dir, BackupConfig{}); err != nil || len(removed) != 0 {
+		t.Fatalf("zero counts keep everything: removed %v, err %v", removed, err)
+	}
+	if removed, err := pruneBackups(filepath.Join(dir, "missing"), BackupConfig{keepDaily: 1}); err != nil || len(removed) != 0 {
+		t.Fatalf("missing dir: removed %v, err %v", removed, err)
+	}
+}
+
+func TestPruneBackupsAlwaysKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	touchBackups(t, dir, "backup-2025-03-10T120000Z.db", "backup-2025-03-10T110000Z.db")
+
+	if _, err := pruneBackups(dir, BackupConfig{keepDaily: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := remainingFiles(t, dir); len(got) != 1 || got[0] != "backup-2025-03-10T120000Z.db" {
+		t.Fatalf("remaining: got %v", got)
+	}
+}
+
+func TestWriteVerifiedBackupRecordsManifest(t *testing.T) {
+	db := newTestDB(t)
+	insertSnapshotAt(db, "", 100, map[string]int64{"A": 1}, 1)
+	insertSnapshotAt(db, "", 200, map[string]int64{"A": 2, "B": 5}, 2)
+	dir := filepath.Join(t.TempDir(), "backups")
+	now := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	if _, err := writeVerifiedBackup(db, dir, now); err != nil {
+		t.Fatalf("writeVerifiedBackup: %v", err)
+	}
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := manifest["backup-2025-03-04T050607Z.db"]
+	if !ok || !record.Verified || record.Snapshots != 2 || record.Error != "" || !record.Taken.Equal(now) {
+		t.Fatalf("manifest record: got %+v", record)
+	}
+	size, sum, _ := checksumFile(filepath.Join(dir, record.File))
+	if record.Size != size || record.SHA256 != sum || len(sum) != 64 {
+		t.Fatalf("checksum: want %d/%s, got %d/%s", size, sum, record.Size, record.SHA256)
+	}
+}
+
+func TestVerifyBackupFlagsBadBackups(t *testing.T) {
+	db := newTestDB(t)
+	insertSnapshotAt(db, "", 100, map[string]int64{"A": 1}, 1)
+	dir := t.TempDir()
+	filename, err := backupWithVacuumInto(context.Background(), db, dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record, err := verifyBackup(db, filename, 100); err != nil || !record.Verified {
+		t.Fatalf("good backup: got %+v, err %v", record, err)
+	}
+	if record, err := verifyBackup(db, filename, 200); err == nil || record.Verified {
+		t.Fatalf("backup older than the live db must fail, got %+v", record)
+	}
+	db.Exec(`UPDATE snapshot_clicks SET clicks = 9 WHERE ts = 100`)
+	if _, err := verifyBackup(db, filename, 100); err == nil {
+		t.Fatal("backup disagreeing with the live db must fail")
+	}
+
+	corruptFile(t, filename)
+	if record, err := verifyBackup(db, filename, 100); err == nil || record.Verified {
+		t.Fatalf("corrupt backup must fail, got %+v", record)
+	}
+}
+
+func TestPruneBackupsKeepsLastVerified(t *testing.T) {
+	dir := t.TempDir()
+	touchBackups(t, dir,
+		"backup-2025-03-10T120000Z.db",
+		"backup-2025-03-10T110000Z.db",
+		"backup-2025-03-01T120000Z.db", // the only verified backup
+		"backup-2025-02-01T120000Z.db",
+	)
+	updateManifest(dir, func(m BackupManifest) {
+		m["backup-2025-03-10T120000Z.db"] = BackupRecord{File: "backup-2025-03-10T120000Z.db", Error: "integrity check failed"}
+		m["backup-2025-03-01T120000Z.db"] = BackupRecord{File: "backup-2025-03-01T120000Z.db", Verified: true}
+		m["backup-2025-02-01T120000Z.db"] = BackupRecord{File: "backup-2025-02-01T120000Z.db", Verified: true}
+	})
+
+	if _, err := pruneBackups(dir, BackupConfig{keepHourly: 1}); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	want := []string{"backup-2025-03-01T120000Z.db", "backup-2025-03-10T120000Z.db", "manifest.json"}
+	got := remainingFiles(t, dir)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("remaining: want %v, got %v", want, got)
+	}
+	manifest, _ := loadManifest(dir)
+	if _, ok := manifest["backup-2025-02-01T120000Z.db"]; ok || len(manifest) != 2 {
+		t.Fatalf("pruned backups should leave the manifest: %v", manifest)
+	}
+}
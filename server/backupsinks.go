@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupSink is somewhere verified backups are shipped to after they are
+// written to data/backups, so losing the disk the database is on does not
+// also lose the backups. Objects are named like the local files, plus a
+// suffix for sinks that transform them.
+type BackupSink interface {
+	String() string
+	Put(ctx context.Context, path string) error
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// newBackupSink returns nil when no sink is configured; backups then only
+// live in data/backups.
+func newBackupSink(config BackupSinkConfig) (BackupSink, error) {
+	switch config.kind {
+	case "", "none":
+		return nil, nil
+	case "local":
+		if config.dir == "" {
+			return nil, fmt.Errorf("BACKUP_SINK=local needs BACKUP_SINK_DIR")
+		}
+		return &LocalSink{dir: config.dir}, nil
+	case "gzip":
+		if config.dir == "" {
+			return nil, fmt.Errorf("BACKUP_SINK=gzip needs BACKUP_SINK_DIR")
+		}
+		return &LocalSink{dir: config.dir, gzip: true}, nil
+	case "s3":
+		sink, err := NewS3Sink(config.s3)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+	return nil, fmt.Errorf("unknown BACKUP_SINK %q", config.kind)
+}
+
+// shipBackup copies a verified backup to the sink and applies the retention
+// policy there too. Only verified backups reach a sink, so every object in
+// it counts as good.
+func shipBackup(ctx context.Context, sink BackupSink, path string, config BackupConfig) ([]string, error) {
+	if err := sink.Put(ctx, path); err != nil {
+		return nil, fmt.Errorf("upload to %s: %w", sink, err)
+	}
+	names, err := sink.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", sink, err)
+	}
+
+	var backups []backupFile
+	for _, name := range names {
+		if taken, ok := parseBackupName(strings.TrimSuffix(name, ".gz")); ok {
+			backups = append(backups, backupFile{path: name, taken: taken, verified: true})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].taken.After(backups[j].taken) })
+
+	var removed []string
+	for _, b := range backupsToPrune(backups, config) {
+		if err := sink.Delete(ctx, b.path); err != nil {
+			return removed, fmt.Errorf("delete %s from %s: %w", b.path, sink, err)
+		}
+		removed = append(removed, b.path)
+	}
+	return removed, nil
+}
+
+// ---------- Local -------------
+
+// LocalSink copies backups into another directory, ideally on another disk,
+// optionally gzip compressed.
+type LocalSink struct {
+	dir  string
+	gzip bool
+}
+
+func (s *LocalSink) String() string {
+	if s.gzip {
+		return "gzip:" + s.dir
+	}
+	return "local:" + s.dir
+}
+
+func (s *LocalSink) Put(ctx context.Context, path string) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	if s.gzip {
+		name += ".gz"
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Written under a temporary name so List never sees half a backup.
+	dst := filepath.Join(s.dir, name)
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst + ".tmp")
+
+	var w io.WriteCloser = out
+	if s.gzip {
+		zw := gzip.NewWriter(out)
+		zw.Name = filepath.Base(path)
+		w = zw
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return err
+	}
+	if s.gzip {
+		if err := w.Close(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+func (s *LocalSink) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *LocalSink) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, filepath.Base(name)))
+}
+
+// ---------- S3 -------------
+
+// S3Sink uploads backups to an S3 compatible object store (AWS, MinIO, R2,
+// ...) using path style urls and AWS signature version 4.
+type S3Sink struct {
+	endpoint *url.URL
+	config   S3Config
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewS3Sink(config S3Config) (*S3Sink, error) {
+	if config.endpoint == "" || config.bucket == "" {
+		return nil, fmt.Errorf("BACKUP_SINK=s3 needs S3_ENDPOINT and S3_BUCKET")
+	}
+	if config.accessKey == "" || config.secretKey == "" {
+		return nil, fmt.Errorf("BACKUP_SINK=s3 needs S3_ACCESS_KEY and S3_SECRET_KEY")
+	}
+	endpoint, err := url.Parse(config.endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", config.endpoint)
+	}
+	if config.region == "" {
+		config.region = "us-east-1"
+	}
+	return &S3Sink{
+		endpoint: endpoint,
+		config:   config,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+func (s *S3Sink) String() string {
+	return "s3://" + s.config.bucket + "/" + s.config.prefix
+}
+
+func (s *S3Sink) objectURL(name string) string {
+	u := *s.endpoint
+	u.Path = "/" + s.config.bucket + "/" + s.config.prefix + name
+	return u.String()
+}
+
+func (s *S3Sink) Put(ctx context.Context, path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(filepath.Base(path)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.sqlite3")
+	_, err = s.do(req, body)
+	return err
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Sink) List(ctx context.Context) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		u := *s.endpoint
+		u.Path = "/" + s.config.bucket
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := s.do(req, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(raw, &result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.config.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Sink) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(req, nil)
+	return err
+}
+
+func (s *S3Sink) do(req *http.Request, body []byte) ([]byte, error) {
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	signV4(req, hex.EncodeToString(sum[:]), s.config, "s3", s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(raw)))
+	}
+	return raw, nil
+}
+
+// signV4 adds an AWS signature version 4 Authorization header to req. The
+// host and every x-amz-* header are signed.
+func signV4(req *http.Request, payloadHash string, config S3Config, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + config.region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+config.secretKey), day)
+	key = hmacSHA256(key, config.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts parameters and escapes them the way SigV4 wants,
+// with spaces as %20 rather than +.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
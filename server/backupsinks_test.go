@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// From the AWS signature version 4 test suite (get-vanilla).
+func TestSignV4MatchesReferenceVector(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	config := S3Config{region: "us-east-1", accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	emptyHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	signV4(req, emptyHash, config, "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization:\nwant %s\ngot  %s", want, got)
+	}
+}
+
+func writeBackupFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGzipSinkRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	sink := &LocalSink{dir: filepath.Join(t.TempDir(), "offsite"), gzip: true}
+	ctx := context.Background()
+
+	path := writeBackupFile(t, src, "backup-2025-03-10T120000Z.db", strings.Repeat("sqlite ", 1000))
+	if err := sink.Put(ctx, path); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	names, err := sink.List(ctx)
+	if err != nil || len(names) != 1 || names[0] != "backup-2025-03-10T120000Z.db.gz" {
+		t.Fatalf("list: got %v, err %v", names, err)
+	}
+
+	f, _ := os.Open(filepath.Join(sink.dir, names[0]))
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	content, _ := io.ReadAll(zr)
+	if string(content) != strings.Repeat("sqlite ", 1000) {
+		t.Fatal("decompressed backup differs from the original")
+	}
+
+	if err := sink.Delete(ctx, names[0]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if names, _ := sink.List(ctx); len(names) != 0 {
+		t.Fatalf("after delete: got %v", names)
+	}
+}
+
+// fakeS3 is a tiny stand-in for MinIO: path style buckets, PUT, DELETE and
+// ListObjectsV2, refusing requests that aren't signed with the right key id.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=minio/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "backups" {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		var result listBucketResult
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{k})
+		}
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"ListBucketResult"`
+			listBucketResult
+		}{listBucketResult: result})
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func TestS3SinkShipsAndPrunes(t *testing.T) {
+	store := &fakeS3{objects: map[string][]byte{"other/unrelated": nil}}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	sink, err := newBackupSink(BackupSinkConfig{kind: "s3", s3: S3Config{
+		endpoint: server.URL, bucket: "backups", prefix: "clicks/", accessKey: "minio", secretKey: "minio123",
+	}})
+	if err != nil {
+		t.Fatalf("newBackupSink: %v", err)
+	}
+
+	src := t.TempDir()
+	ctx := context.Background()
+	config := BackupConfig{keepHourly: 2}
+	for _, name := range []string{
+		"backup-2025-03-10T100000Z.db",
+		"backup-2025-03-10T110000Z.db",
+		"backup-2025-03-10T120000Z.db",
+	} {
+		if _, err := shipBackup(ctx, sink, writeBackupFile(t, src, name, name), config); err != nil {
+			t.Fatalf("ship %s: %v", name, err)
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if len(store.objects) != 3 {
+		t.Fatalf("objects: want 2 backups and the unrelated key, got %v", store.objects)
+	}
+	if string(store.objects["clicks/backup-2025-03-10T120000Z.db"]) != "backup-2025-03-10T120000Z.db" {
+		t.Fatalf("newest backup missing or wrong: %v", store.objects)
+	}
+	if _, ok := store.objects["clicks/backup-2025-03-10T100000Z.db"]; ok {
+		t.Fatal("oldest backup should have been pruned")
+	}
+}
+
+func TestS3SinkRejectsBadCredentials(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+
+	sink, _ := NewS3Sink(S3Config{endpoint: server.URL, bucket: "backups", accessKey: "wrong", secretKey: "x"})
+	path := writeBackupFile(t, t.TempDir(), "backup-2025-03-10T120000Z.db", "x")
+	if err := sink.Put(context.Background(), path); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("want a 403 error, got %v", err)
+	}
+}
+
+func TestNewBackupSinkValidatesConfig(t *testing.T) {
+	for _, config := range []BackupSinkConfig{
+		{kind: "local"},
+		{kind: "gzip"},
+		{kind: "s3"},
+		{kind: "s3", s3: S3Config{endpoint: "http://localhost:9000", bucket: "b"}},
+		{kind: "ftp"},
+	} {
+		if _, err := newBackupSink(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+	if sink, err := newBackupSink(BackupSinkConfig{}); sink != nil || err != nil {
+		t.Fatalf("no sink configured: got %v, %v", sink, err)
+	}
+}
@@ -1,69 +1,337 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	datastar "github.com/starfederation/datastar/sdk/go"
 )
 
-type Broadcaster struct {
+// Broadcaster fans values out to every subscriber. Publish never blocks: when
+// a subscriber's buffer is full its SlowConsumerPolicy decides what gives,
+// and every value it misses is counted. The fan-out happens outside the lock
+// so a stuck subscriber can't hold up the others. A broadcaster made with
+// NewReplayBroadcaster also keeps the last values it published so a
+// subscriber that reconnects can catch up.
+type Broadcaster[T any] struct {
 	sync.Mutex
-	listeners map[chan Point]struct{}
+	policy       SlowConsumerPolicy
+	listeners    map[*Subscription[T]]struct{}
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+	recent       []T // ring buffer, oldest at start
+	start        int
+	count        int
+	idOf         func(T) int64
+	evicted      bool  // whether a value has fallen out of recent
+	lastGone     int64 // id of the newest value no longer kept
+}
+
+// SlowConsumerPolicy is what Publish does for a subscriber that hasn't made
+// room for the next value:
+//
+//	drop-oldest  discard the oldest buffered value to make room (the default)
+//	coalesce     buffer only the latest value, for values that replace the last
+//	disconnect   skip the value and close the subscription after maxDrops in a row
+type SlowConsumerPolicy struct {
+	mode     string
+	maxDrops int
+}
+
+const (
+	policyDropOldest = "drop-oldest"
+	policyCoalesce   = "coalesce"
+	policyDisconnect = "disconnect"
+)
+
+// Subscription is one subscriber's buffer. C is closed when the subscriber is
+// disconnected for falling behind.
+type Subscription[T any] struct {
+	C       <-chan T
+	ch      chan T
+	mu      sync.Mutex
+	closed  bool
+	streak  int // drops in a row
+	dropped atomic.Int64
+}
+
+// Dropped is how many values this subscriber missed.
+func (s *Subscription[T]) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription[T]) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
 }
 
-func NewBroadcaster() *Broadcaster {
-	return &Broadcaster{listeners: make(map[chan Point]struct{})}
+func NewBroadcaster[T any](policy SlowConsumerPolicy) *Broadcaster[T] {
+	return &Broadcaster[T]{policy: policy, listeners: make(map[*Subscription[T]]struct{})}
 }
 
-func (b *Broadcaster) Subscribe() chan Point {
-	ch := make(chan Point, 100) // Remove buffer ?
+// NewReplayBroadcaster keeps the last size values for SubscribeSince. idOf
+// gives each value its event id, which must grow with every publish.
+func NewReplayBroadcaster[T any](policy SlowConsumerPolicy, size int, idOf func(T) int64) *Broadcaster[T] {
+	b := NewBroadcaster[T](policy)
+	b.recent = make([]T, max(size, 0))
+	b.idOf = idOf
+	return b
+}
+
+func (b *Broadcaster[T]) Subscribe() *Subscription[T] {
 	b.Lock()
-	b.listeners[ch] = struct{}{}
+	defer b.Unlock()
+	return b.subscribe()
+}
+
+func (b *Broadcaster[T]) subscribe() *Subscription[T] {
+	size := 100
+	if b.policy.mode == policyCoalesce {
+		size = 1
+	}
+	ch := make(chan T, size)
+	sub := &Subscription[T]{C: ch, ch: ch}
+	b.listeners[sub] = struct{}{}
+	return sub
+}
+
+// SubscribeSince subscribes and returns the kept values published after
+// lastID, oldest first. Nothing is missed or repeated between the replay and
+// the channel. ok is false when values after lastID may no longer be kept,
+// e.g. after a restart or a long disconnect; the subscriber then has to
+// catch up some other way.
+func (b *Broadcaster[T]) SubscribeSince(lastID int64) (sub *Subscription[T], missed []T, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	sub = b.subscribe()
+	if b.count == 0 {
+		return sub, nil, false
+	}
+	if b.idOf(b.at(0)) > lastID && !(b.evicted && b.lastGone <= lastID) {
+		return sub, nil, false
+	}
+	for i := 0; i < b.count; i++ {
+		if v := b.at(i); b.idOf(v) > lastID {
+			missed = append(missed, v)
+		}
+	}
+	return sub, missed, true
+}
+
+func (b *Broadcaster[T]) at(i int) T {
+	return b.recent[(b.start+i)%len(b.recent)]
+}
+
+// Unsubscribe may be called after the subscription was disconnected.
+func (b *Broadcaster[T]) Unsubscribe(sub *Subscription[T]) {
+	b.Lock()
+	delete(b.listeners, sub)
 	b.Unlock()
-	return ch
+	sub.close()
 }
 
-func (b *Broadcaster) Unsubscribe(ch chan Point) {
+// Publish keeps the value for replay and copies the subscriber list under the
+// lock, then delivers to each subscriber holding only that subscriber's lock.
+func (b *Broadcaster[T]) Publish(v T) {
 	b.Lock()
-	delete(b.listeners, ch)
+	b.keep(v)
+	subs := make([]*Subscription[T], 0, len(b.listeners))
+	for sub := range b.listeners {
+		subs = append(subs, sub)
+	}
 	b.Unlock()
-	close(ch)
+
+	for _, sub := range subs {
+		if b.deliver(sub, v) {
+			b.Unsubscribe(sub)
+			b.disconnected.Add(1)
+		}
+	}
 }
 
-func (b *Broadcaster) Publish(p Point) {
+// deliver hands v to one subscriber and reports whether it should be
+// disconnected.
+func (b *Broadcaster[T]) deliver(sub *Subscription[T], v T) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return false
+	}
+	select {
+	case sub.ch <- v:
+		sub.streak = 0
+		return false
+	default:
+	}
+
+	sub.dropped.Add(1)
+	b.dropped.Add(1)
+	if b.policy.mode == policyDisconnect {
+		sub.streak++
+		return sub.streak >= max(b.policy.maxDrops, 1)
+	}
+	// Make room by discarding the oldest value; the subscriber may have
+	// taken it in the meantime, in which case there is room already.
+	select {
+	case <-sub.ch:
+	default:
+	}
+	select {
+	case sub.ch <- v:
+	default:
+	}
+	return false
+}
+
+func (b *Broadcaster[T]) keep(v T) {
+	if len(b.recent) == 0 {
+		return
+	}
+	if b.count < len(b.recent) {
+		b.recent[(b.start+b.count)%len(b.recent)] = v
+		b.count++
+		return
+	}
+	b.evicted, b.lastGone = true, b.idOf(b.recent[b.start])
+	b.recent[b.start] = v
+	b.start = (b.start + 1) % len(b.recent)
+}
+
+func (b *Broadcaster[T]) Len() int {
 	b.Lock()
 	defer b.Unlock()
-	for ch := range b.listeners {
-		select {
-		case ch <- p:
-			// noop
-		default:
-			// Channel buffer is full, skip sending
-		}
+	return len(b.listeners)
+}
+
+// worstDrops is the most values missed by any current subscriber.
+func (b *Broadcaster[T]) worstDrops() int64 {
+	b.Lock()
+	defer b.Unlock()
+	var worst int64
+	for sub := range b.listeners {
+		worst = max(worst, sub.Dropped())
 	}
+	return worst
 }
 
 func (app *App) sendPeriodicBroadcasts() {
 	if !app.configuration.broadcastEnabled() {
 		return
 	}
+	app.workers.Add(1)
 	go func() {
+		defer app.workers.Done()
 		ticker := time.NewTicker(app.configuration.broadcastInterval)
 		defer ticker.Stop()
 
-		var previousClickACount, previousClickBCount int64
-		for range ticker.C {
-			currentClicksA := app.clicksA.Load()
-			currentClicksB := app.clicksB.Load()
-			if currentClicksA == previousClickACount &&
-				currentClicksB == previousClickBCount {
+		var previousClicks map[string]int64
+		var lastID int64
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			currentClicks := app.clicks.Snapshot()
+			if sameCounts(currentClicks, previousClicks) {
 				continue
 			}
-			app.broadcaster.Publish(Point{
-				Ts:      time.Now().UTC().Unix(),
-				ClicksA: currentClicksA,
-				ClicksB: currentClicksB,
-			})
-			previousClickACount, previousClickBCount = currentClicksA, currentClicksB
+			point := stampPoint(currentClicks, time.Now(), lastID)
+			app.broadcaster.Publish(point)
+			previousClicks, lastID = currentClicks, point.ID
+		}
+	}()
+}
+
+// stampPoint makes the next feed point. Its id is the publish time in
+// milliseconds, bumped past lastID if needed, so points published within the
+// same second (BROADCAST_INTERVAL under 1s) still get distinct, growing ids.
+func stampPoint(clicks map[string]int64, now time.Time, lastID int64) Point {
+	id := max(now.UnixMilli(), lastID+1)
+	return Point{Ts: id / 1000, Clicks: clicks, ID: id}
+}
+
+// defaultStreamInterval is how often counter changes are pushed to /stream
+// when STREAM_INTERVAL is unset or not positive.
+const defaultStreamInterval = 100 * time.Millisecond
+
+// publishCounterChanges is the single publisher behind /stream. It samples
+// the counters once per interval and, when they changed, encodes one datastar
+// event with every counter and hands the same bytes to each connection.
+// Clicks between two samples are coalesced into one event. Since each event
+// carries the full counts, a connection that misses one catches up with the
+// next.
+func (app *App) publishCounterChanges() {
+	interval := app.configuration.streamInterval
+	if interval <= 0 {
+		interval = defaultStreamInterval
+	}
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var previous map[string]int64
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			previous = app.publishCounters(previous)
 		}
 	}()
 }
+
+// publishCounters publishes the counters if they differ from previous and
+// returns what was last published.
+func (app *App) publishCounters(previous map[string]int64) map[string]int64 {
+	current := app.clicks.Snapshot()
+	if sameCounts(current, previous) {
+		return previous
+	}
+	signals := app.liveSignals(current)
+	app.counterStream.Publish(CounterEvent{
+		sse: encodeCounterEvent(signals),
+		ws:  encodeSocketMessage(SocketMessage{Type: "signals", Signals: signals}),
+	})
+	return current
+}
+
+// liveSignals are what /stream and /ws keep up to date: the counters and,
+// once an admin has announced one, the message. Every event carries all of
+// them, so a coalesced event can't lose an announcement.
+func (app *App) liveSignals(counters map[string]int64) Signal {
+	signals := Signal{"counters": counters}
+	if announced := app.announcement.Load(); announced != nil {
+		signals["message"] = *announced
+	}
+	return signals
+}
+
+// CounterEvent is one counter update, encoded once for each transport.
+type CounterEvent struct {
+	sse []byte // datastar merge-signals event for /stream
+	ws  []byte // SocketMessage for /ws
+}
+
+// encodeCounterEvent renders the signals as a complete datastar
+// merge-signals event, byte for byte what sse.MarshalAndMergeSignals writes,
+// including the extra blank line the sdk ends every event with.
+func encodeCounterEvent(signals Signal) []byte {
+	encoded, _ := json.Marshal(signals)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\nretry: %d\ndata: %s%s\n\n\n",
+		datastar.EventTypeMergeSignals, datastar.DefaultSseRetryDuration.Milliseconds(),
+		datastar.SignalsDatalineLiteral, encoded)
+	return buf.Bytes()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pointIDs(pts []Point) []int64 {
+	ids := []int64{}
+	for _, p := range pts {
+		ids = append(ids, p.Ts)
+	}
+	return ids
+}
+
+func newPointBroadcaster(size int) *Broadcaster[Point] {
+	return NewReplayBroadcaster(SlowConsumerPolicy{}, size, pointID)
+}
+
+func TestSubscribeSinceReplaysKeptPoints(t *testing.T) {
+	b := newPointBroadcaster(3)
+	for ts := int64(1); ts <= 5; ts++ { // 1 and 2 fall out of the ring
+		b.Publish(Point{Ts: ts, ID: ts})
+	}
+
+	tests := []struct {
+		lastID int64
+		want   []int64
+		ok     bool
+	}{
+		{3, []int64{4, 5}, true},
+		{5, []int64{}, true},
+		{9, []int64{}, true},
+		{2, []int64{3, 4, 5}, true}, // 2 was the last point evicted
+		{1, nil, false},
+	}
+	for _, tc := range tests {
+		sub, missed, ok := b.SubscribeSince(tc.lastID)
+		b.Unsubscribe(sub)
+		if ok != tc.ok || (ok && !reflect.DeepEqual(pointIDs(missed), tc.want)) {
+			t.Errorf("since %d: want %v/%v, got %v/%v", tc.lastID, tc.want, tc.ok, pointIDs(missed), ok)
+		}
+	}
+}
+
+func TestSubscribeSinceWithoutHistory(t *testing.T) {
+	for _, b := range []*Broadcaster[Point]{NewBroadcaster[Point](SlowConsumerPolicy{}), newPointBroadcaster(10)} {
+		sub, missed, ok := b.SubscribeSince(100)
+		if ok || missed != nil {
+			t.Errorf("nothing kept: want a resync, got %v/%v", missed, ok)
+		}
+		b.Publish(Point{Ts: 200, ID: 200})
+		if got := <-sub.C; got.Ts != 200 {
+			t.Errorf("subscriber should still get new points, got %+v", got)
+		}
+		b.Unsubscribe(sub)
+	}
+}
+
+// feedBody runs metricsFeed until the handler is connected and returns what it
+// wrote.
+func feedBody(t *testing.T, app *App, req *http.Request) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	rr := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		app.metricsFeed(rr, req.WithContext(ctx))
+		close(finished)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for app.feedClients.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("feed never connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-finished
+	return rr.Body.String()
+}
+
+func TestMetricsFeedResumesFromLastEventID(t *testing.T) {
+	app := newTestApp()
+	app.broadcaster = newPointBroadcaster(10)
+	for ts := int64(100); ts <= 400; ts += 100 {
+		app.broadcaster.Publish(Point{Ts: ts, Clicks: map[string]int64{"A": ts}, ID: ts * 1000})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics/feed", nil)
+	req.Header.Set("Last-Event-ID", "200000")
+	body := feedBody(t, app, req)
+	if strings.Contains(body, "id:200000") || !strings.Contains(body, "id:300000\n") || !strings.Contains(body, "id:400000\n") {
+		t.Fatalf("want points 300 and 400 replayed, got %q", body)
+	}
+	if strings.Contains(body, "resync") {
+		t.Fatalf("no resync expected, got %q", body)
+	}
+
+	// A page that just loaded its history resumes with ?since=.
+	body = feedBody(t, app, httptest.NewRequest(http.MethodGet, "/metrics/feed?since=300", nil))
+	if strings.Contains(body, "id:300000") || !strings.Contains(body, "id:400000\n") {
+		t.Fatalf("want point 400 replayed, got %q", body)
+	}
+}
+
+func TestFeedIDsWithinOneSecond(t *testing.T) {
+	app := newTestApp()
+	app.broadcaster = newPointBroadcaster(10)
+	now := time.UnixMilli(1_700_000_000_250)
+	first := stampPoint(map[string]int64{"A": 1}, now, 0)
+	second := stampPoint(map[string]int64{"A": 2}, now, first.ID) // same millisecond
+	third := stampPoint(map[string]int64{"A": 3}, now.Add(500*time.Millisecond), second.ID)
+	if first.Ts != second.Ts || first.Ts != third.Ts || !(first.ID < second.ID && second.ID < third.ID) {
+		t.Fatalf("want one second and growing ids, got %+v %+v %+v", first, second, third)
+	}
+	for _, p := range []Point{first, second, third} {
+		app.broadcaster.Publish(p)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics/feed", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(first.ID, 10))
+	body := feedBody(t, app, req)
+	if !strings.Contains(body, `"A":2`) || !strings.Contains(body, `"A":3`) {
+		t.Fatalf("points later in the same second should be replayed, got %q", body)
+	}
+}
+
+func TestMetricsFeedAsksForResyncWhenGapIsTooOld(t *testing.T) {
+	app := newTestApp()
+	app.broadcaster = newPointBroadcaster(2)
+	for ts := int64(100); ts <= 400; ts += 100 {
+		app.broadcaster.Publish(Point{Ts: ts, ID: ts * 1000})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics/feed", nil)
+	req.Header.Set("Last-Event-ID", "100000")
+	body := feedBody(t, app, req)
+	if !strings.HasPrefix(body, "event:resync\n") || strings.Contains(body, "id:") {
+		t.Fatalf("want only a resync event, got %q", body)
+	}
+
+	// Fresh connections neither replay nor resync.
+	if body := feedBody(t, app, httptest.NewRequest(http.MethodGet, "/metrics/feed", nil)); body != "" {
+		t.Fatalf("fresh connection: want no events yet, got %q", body)
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	publish := func(b *Broadcaster[Point], from, to int64) {
+		for ts := from; ts <= to; ts++ {
+			b.Publish(Point{Ts: ts, ID: ts})
+		}
+	}
+	drain := func(sub *Subscription[Point]) []int64 {
+		var ids []int64
+		for len(sub.C) > 0 {
+			ids = append(ids, (<-sub.C).Ts)
+		}
+		return ids
+	}
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		b := NewBroadcaster[Point](SlowConsumerPolicy{mode: policyDropOldest})
+		sub := b.Subscribe()
+		publish(b, 1, int64(cap(sub.C))+5)
+		got := drain(sub)
+		if got[0] != 6 || got[len(got)-1] != int64(cap(sub.C))+5 || sub.Dropped() != 5 {
+			t.Fatalf("want the newest %d points and 5 drops, got %d..%d and %d drops",
+				cap(sub.C), got[0], got[len(got)-1], sub.Dropped())
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		b := NewBroadcaster[Point](SlowConsumerPolicy{mode: policyCoalesce})
+		sub := b.Subscribe()
+		publish(b, 1, 10)
+		if got := drain(sub); len(got) != 1 || got[0] != 10 || sub.Dropped() != 9 {
+			t.Fatalf("want only the latest point, got %v with %d drops", got, sub.Dropped())
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		b := NewBroadcaster[Point](SlowConsumerPolicy{mode: policyDisconnect, maxDrops: 3})
+		slow, fast := b.Subscribe(), b.Subscribe()
+		full := int64(cap(slow.C))
+		publish(b, 1, full)
+		drain(fast)
+		publish(b, full+1, full+2) // two drops in a row for slow
+		<-slow.C                   // a little progress resets the streak
+		publish(b, full+3, full+3)
+		if b.Len() != 2 || b.disconnected.Load() != 0 {
+			t.Fatal("slow subscriber disconnected too early")
+		}
+		publish(b, full+4, full+6)
+		if b.Len() != 1 || b.disconnected.Load() != 1 {
+			t.Fatalf("slow subscriber should be disconnected, %d listeners", b.Len())
+		}
+		for range slow.C { // closed once drained
+		}
+		if got := drain(fast); len(got) != 6 || fast.Dropped() != 0 {
+			t.Fatalf("fast subscriber should get everything, got %v", got)
+		}
+		b.Unsubscribe(slow) // a handler still unsubscribes afterwards
+	})
+}
+
+func TestPublishDoesNotRaceUnsubscribe(t *testing.T) {
+	b := NewBroadcaster[Point](SlowConsumerPolicy{mode: policyDisconnect, maxDrops: 1})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ts := int64(0); ts < 2000; ts++ {
+			b.Publish(Point{Ts: ts, ID: ts})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		b.Unsubscribe(b.Subscribe())
+	}
+	<-done
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const usage = `usage: server [command]
+
+With no command the server starts. Commands:
+
+  migrate status            list migrations and whether they are applied
+  migrate up [version]      apply pending migrations, up to version if given
+  migrate rollback [steps]  roll back the latest applied migrations (default 1)
+  stats                     current counts and a summary of the snapshots
+  export [-format csv|ndjson] [-from ts] [-to ts]
+                            write every snapshot to stdout
+  backup [-dir dir]         take a verified backup now
+  restore [-force] <file>   replace the database with a backup
+  set-counts [-force] <option>=<clicks>...
+                            correct counters, e.g. after abuse
+
+Every command takes -db (default clicks.db in DATA_DIR, read from the
+environment or .env like the server does), and stats, export and set-counts
+take -contest for a user contest. migrate up and rollback, restore and
+set-counts refuse to run while a server is using the database unless given
+-force.
+`
+
+// runCommand runs a maintenance subcommand and returns the exit code.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	_ = godotenv.Load() // optional for commands
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(args[1:], stdout, stderr)
+	case "stats":
+		return statsCommand(args[1:], stdout, stderr)
+	case "export":
+		return exportCommand(args[1:], stdout, stderr)
+	case "backup":
+		return backupCommand(args[1:], stdout, stderr)
+	case "restore":
+		return restoreCommand(args[1:], stdout, stderr)
+	case "set-counts":
+		return setCountsCommand(args[1:], stdout, stderr)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+	return 2
+}
+
+func migrateCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", commandConfig().dbPath(), "database file")
+	force := flags.Bool("force", false, "migrate even though a server is using the database")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	action, arg := "status", ""
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+	}
+	if flags.NArg() > 1 {
+		arg = flags.Arg(1)
+	}
+	n := 0
+	if arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 0 {
+			fmt.Fprintf(stderr, "%s: expected a non-negative number, got %q\n", action, arg)
+			return 2
+		}
+	}
+
+	if action != "status" && refuseWhileServing(*dbPath, *force, stderr) {
+		return 1
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	db, err := openSQLite(*dbPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	var done []Migration
+	verb := "applied"
+	switch action {
+	case "status":
+		states, err := migrationStatus(db.DB, migrations)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != 0 {
+				applied = time.Unix(s.AppliedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		tw.Flush()
+		return 0
+	case "up":
+		done, err = migrateUp(db.DB, migrations, n)
+	case "rollback":
+		if arg == "" {
+			n = 1
+		}
+		verb = "rolled back"
+		done, err = migrateDown(db.DB, migrations, n)
+	default:
+		fmt.Fprintf(stderr, "unknown migrate action %q\n\n%s", action, usage)
+		return 2
+	}
+
+	for _, m := range done {
+		fmt.Fprintf(stdout, "%s %04d_%s\n", verb, m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Fprintln(stdout, "nothing to do")
+	}
+	return 0
+}
+
+// openExisting opens the database at path for a command, without creating
+// it or touching its schema.
+func openExisting(path string) (DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return DB{}, err
+	}
+	return openSQLite(path)
+}
+
+func statsCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", commandConfig().dbPath(), "database file")
+	contest := flags.String("contest", "", "user contest slug, the main contest if empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	db, err := openExisting(*dbPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	latest, found, err := db.LatestSnapshot(*contest)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if !found {
+		fmt.Fprintln(stdout, "no snapshots yet")
+		return 0
+	}
+	logged, err := db.ClicksSinceSnapshot(*contest)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	var count, first int64
+	err = db.QueryRow(`SELECT COUNT(*), MIN(ts) FROM `+allSnapshots+` WHERE contest = ?`, *contest).Scan(&count, &first)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "snapshots\t%d, %s to %s\n", count, formatTs(first), formatTs(latest.Ts))
+	fmt.Fprintf(tw, "views\t%d\n", latest.views)
+	fmt.Fprintln(tw, "OPTION\tCLICKS\tSINCE SNAPSHOT")
+	for _, option := range sortedOptions([]ViewPoint{latest}, logged) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", option, latest.Clicks[option]+logged[option], logged[option])
+	}
+	tw.Flush()
+	if serverRunning(*dbPath) {
+		fmt.Fprintln(stdout, "a server is using this database, its counts may be ahead")
+	}
+	return 0
+}
+
+func exportCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", commandConfig().dbPath(), "database file")
+	contest := flags.String("contest", "", "user contest slug, the main contest if empty")
+	format := flags.String("format", "csv", "csv or ndjson")
+	from := flags.Int64("from", 0, "first snapshot, unix seconds")
+	to := flags.Int64("to", 0, "last snapshot, unix seconds")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "csv" && *format != "ndjson" {
+		fmt.Fprintf(stderr, "unknown format %q, expected csv or ndjson\n", *format)
+		return 2
+	}
+	db, err := openExisting(*dbPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	points, err := db.History(*contest, HistoryQuery{From: *from, To: *to})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *format == "ndjson" {
+		enc := json.NewEncoder(stdout)
+		for _, p := range points {
+			enc.Encode(struct {
+				Ts     int64            `json:"ts"`
+				Views  int64            `json:"views"`
+				Clicks map[string]int64 `json:"clicks"`
+			}{p.Ts, p.views, p.Clicks})
+		}
+		return 0
+	}
+
+	options := sortedOptions(points, nil)
+	w := csv.NewWriter(stdout)
+	w.Write(append([]string{"ts", "time", "views"}, options...))
+	for _, p := range points {
+		row := []string{strconv.FormatInt(p.Ts, 10), formatTs(p.Ts), strconv.FormatInt(p.views, 10)}
+		for _, option := range options {
+			row = append(row, strconv.FormatInt(p.Clicks[option], 10))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func backupCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", commandConfig().dbPath(), "database file")
+	dir := flags.String("dir", commandConfig().backupDir(), "backup directory")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	db, err := openExisting(*dbPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	filename, err := writeVerifiedBackup(db, *dir, time.Now())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "backup written to", filename)
+	return 0
+}
+
+// restoreCommand replaces the database with a backup that passes the
+// integrity check. The replaced database is kept next to it, like a
+// quarantined one.
+func restoreCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", commandConfig().dbPath(), "database file")
+	force := flags.Bool("force", false, "restore even though a server is using the database")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(stderr, "restore: expected one backup file\n\n%s", usage)
+		return 2
+	}
+	backup := flags.Arg(0)
+	if refuseWhileServing(*dbPath, *force, stderr) {
+		return 1
+	}
+	if _, err := os.Stat(backup); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := checkFileIntegrity(backup); err != nil {
+		fmt.Fprintln(stderr, "not restoring", backup+":", err)
+		return 1
+	}
+
+	replaced := fmt.Sprintf("%s.replaced-%s", *dbPath, time.Now().UTC().Format(backupLayout))
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(*dbPath+suffix, replaced+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	if err := copyFile(backup, *dbPath); err != nil {
+		fmt.Fprintln(stderr, "restore", backup+":", err)
+		return 1
+	}
+	if _, err := os.Stat(replaced); err == nil {
+		fmt.Fprintln(stdout, "previous database kept as", replaced)
+	}
+	fmt.Fprintln(stdout, "restored", backup)
+	return 0
+}
+
+// setCountsCommand records a snapshot with the given counters, so a server
+// started afterwards picks them up. Options not given keep their count.
+func setCountsCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("set-counts", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", commandConfig().dbPath(), "database file")
+	contest := flags.String("contest", "", "user contest slug, the main contest if empty")
+	force := flags.Bool("force", false, "write even though a server is using the database")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	counts := make(map[string]int64)
+	for _, arg := range flags.Args() {
+		option, raw, ok := strings.Cut(arg, "=")
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if !ok || option == "" || err != nil || n < 0 {
+			fmt.Fprintf(stderr, "set-counts: expected <option>=<clicks>, got %q\n", arg)
+			return 2
+		}
+		counts[option] = n
+	}
+	if len(counts) == 0 {
+		fmt.Fprintf(stderr, "set-counts: nothing to set\n\n%s", usage)
+		return 2
+	}
+	if refuseWhileServing(*dbPath, *force, stderr) {
+		return 1
+	}
+	db, err := openExisting(*dbPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	options, err := optionsOf(db, *contest)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	for option := range counts {
+		if !slices.Contains(options, option) {
+			fmt.Fprintf(stderr, "set-counts: unknown option %q, the contest has %s\n", option, strings.Join(options, ", "))
+			return 2
+		}
+	}
+
+	// Replicated counters restore from their per node counts, which only
+	// grow, so a snapshot can't correct them.
+	if replica, err := db.ReplicaCounts(*contest); err != nil || len(replica) > 0 {
+		fmt.Fprintln(stderr, "set-counts: the counters of a replicated contest can't be set", err)
+		return 1
+	}
+
+	latest, _, err := db.LatestSnapshot(*contest)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	// Logged clicks after the latest snapshot would otherwise be replayed
+	// on top of the new counts; fold them in first.
+	logged, err := db.ClicksSinceSnapshot(*contest)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	clicks := maps.Clone(latest.Clicks)
+	for option, n := range logged {
+		clicks[option] += n
+	}
+	maps.Copy(clicks, counts)
+
+	// One second past the newest logged click, so none of them is replayed.
+	ts := max(time.Now().UTC().Unix(), latest.Ts) + 1
+	if err := db.InsertSnapshot(*contest, ts, clicks, latest.views); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	for _, option := range sortedOptions(nil, counts) {
+		fmt.Fprintf(stdout, "%s: %d -> %d\n", option, latest.Clicks[option]+logged[option], counts[option])
+	}
+	return 0
+}
+
+// commandConfig holds the settings commands share with the server, so their
+// defaults point at the database a server started here uses.
+func commandConfig() *Configuration {
+	return &Configuration{dataDir: os.Getenv("DATA_DIR")}
+}
+
+// optionsOf lists the option ids of a user contest, or of the main
+// contest as contest.json defines it when slug is empty.
+func optionsOf(db DB, slug string) ([]string, error) {
+	if slug == "" {
+		contest, err := loadContestDefinition(os.Getenv("CONTEST_CONFIG"))
+		if err != nil {
+			return nil, err
+		}
+		return optionIDs(contest.Options), nil
+	}
+	stored, err := db.Contests()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range stored {
+		if c.contest.Slug == slug {
+			return optionIDs(c.contest.Options), nil
+		}
+	}
+	return nil, fmt.Errorf("no contest %q", slug)
+}
+
+// refuseWhileServing reports whether a destructive command must stop because
+// a server is using the database, explaining why on stderr.
+func refuseWhileServing(dbPath string, force bool, stderr io.Writer) bool {
+	if !serverRunning(dbPath) {
+		return false
+	}
+	if force {
+		fmt.Fprintln(stderr, "warning: a server is using", dbPath+", continuing because of -force")
+		return false
+	}
+	fmt.Fprintln(stderr, "a server is using", dbPath+"; stop it first or pass -force")
+	return true
+}
+
+// sortedOptions lists every option that appears in points or counts.
+func sortedOptions(points []ViewPoint, counts map[string]int64) []string {
+	seen := make(map[string]bool)
+	for _, p := range points {
+		for option := range p.Clicks {
+			seen[option] = true
+		}
+	}
+	for option := range counts {
+		seen[option] = true
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+func formatTs(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// A running server keeps a marker file next to its database fresh, so
+// commands can tell the database is in use. A server that crashed stops
+// refreshing it and the marker goes stale on its own.
+const serverMarkerInterval = 10 * time.Second
+
+func serverMarkerPath(dbPath string) string {
+	return dbPath + ".server"
+}
+
+func serverRunning(dbPath string) bool {
+	info, err := os.Stat(serverMarkerPath(dbPath))
+	return err == nil && time.Since(info.ModTime()) < 3*serverMarkerInterval
+}
+
+// markDBInUse writes the marker and refreshes it until the app closes. The
+// marker is removed by shutdown once the database is closed.
+func (app *App) markDBInUse() {
+	path := serverMarkerPath(app.configuration.dbPath())
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("pid %d\n", os.Getpid())), 0o644); err != nil {
+		log.Println("Error writing server marker:", err)
+		return
+	}
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		ticker := time.NewTicker(serverMarkerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.done:
+				return
+			case now := <-ticker.C:
+				if err := os.Chtimes(path, now, now); err != nil {
+					log.Println("Error refreshing server marker:", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCommandDB creates a migrated database file with a few snapshots and a
+// logged click after the last one.
+func newCommandDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clicks.db")
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, ts := range []int64{1000, 2000, 3000} {
+		if err := db.InsertSnapshot("", ts, map[string]int64{"A": int64(10 * (i + 1)), "B": int64(i)}, int64(100*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.InsertClickEvents([]ClickEvent{{Ts: 3_001_000, Option: "A", Client: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func runCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCommand(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func markServing(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(serverMarkerPath(path), []byte("pid 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	path := newCommandDB(t)
+	code, out, errOut := runCLI("stats", "-db", path)
+	if code != 0 {
+		t.Fatalf("stats: %d %s", code, errOut)
+	}
+	for _, want := range []string{"3, 1970-01-01T00:16:40Z to 1970-01-01T00:50:00Z", "views      300", "A          31", "B          2"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stats output lacks %q:\n%s", want, out)
+		}
+	}
+	if code, _, _ := runCLI("stats", "-db", filepath.Join(t.TempDir(), "missing.db")); code != 1 {
+		t.Fatalf("stats on a missing database: want exit 1, got %d", code)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	path := newCommandDB(t)
+	code, out, _ := runCLI("export", "-db", path, "-from", "2000")
+	want := "ts,time,views,A,B\n2000,1970-01-01T00:33:20Z,200,20,1\n3000,1970-01-01T00:50:00Z,300,30,2\n"
+	if code != 0 || out != want {
+		t.Fatalf("csv export: %d\n got %q\nwant %q", code, out, want)
+	}
+
+	code, out, _ = runCLI("export", "-db", path, "-format", "ndjson")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var first struct {
+		Ts     int64            `json:"ts"`
+		Views  int64            `json:"views"`
+		Clicks map[string]int64 `json:"clicks"`
+	}
+	if code != 0 || len(lines) != 3 || json.Unmarshal([]byte(lines[0]), &first) != nil || first.Ts != 1000 || first.Clicks["A"] != 10 || first.Views != 100 {
+		t.Fatalf("ndjson export: %d %q", code, out)
+	}
+	if code, _, _ := runCLI("export", "-db", path, "-format", "xml"); code != 2 {
+		t.Fatalf("unknown format: want exit 2, got %d", code)
+	}
+}
+
+func TestBackupAndRestoreCommands(t *testing.T) {
+	path := newCommandDB(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+	code, out, errOut := runCLI("backup", "-db", path, "-dir", dir)
+	if code != 0 || !strings.Contains(out, "backup written to") {
+		t.Fatalf("backup: %d %s %s", code, out, errOut)
+	}
+	backups, _ := listBackups(dir)
+	if len(backups) != 1 {
+		t.Fatalf("want one backup, got %d", len(backups))
+	}
+
+	if code, _, _ := runCLI("set-counts", "-db", path, "A=0"); code != 0 {
+		t.Fatal("set-counts failed")
+	}
+	markServing(t, path)
+	if code, _, errOut := runCLI("restore", "-db", path, backups[0].path); code != 1 || !strings.Contains(errOut, "-force") {
+		t.Fatalf("restore under a live server: want a refusal, got %d %s", code, errOut)
+	}
+	if code, out, errOut := runCLI("restore", "-db", path, "-force", backups[0].path); code != 0 || !strings.Contains(out, "previous database kept") {
+		t.Fatalf("forced restore: %d %s %s", code, out, errOut)
+	}
+	if latest, _ := latestSnapshotIn(path); latest != 3000 {
+		t.Fatalf("restored database should end at the backup's snapshot, got %d", latest)
+	}
+	if code, _, _ := runCLI("restore", "-db", path, "-force", filepath.Join(dir, "missing.db")); code != 1 {
+		t.Fatal("restoring a missing file should fail")
+	}
+}
+
+func TestSetCountsCommand(t *testing.T) {
+	path := newCommandDB(t)
+	code, out, errOut := runCLI("set-counts", "-db", path, "A=5")
+	if code != 0 || out != "A: 31 -> 5\n" {
+		t.Fatalf("set-counts: %d %q %s", code, out, errOut)
+	}
+
+	db, _ := openExisting(path)
+	defer db.Close()
+	app := newApp(db, &Configuration{contest: defaultContest}, &Services{clickLog: &ClickLog{}}, nil)
+	if got := app.clicks.Snapshot(); got["A"] != 5 || got["B"] != 2 || app.views.Load() != 300 {
+		t.Fatalf("a server started afterwards should see the new counts, got %v and %d views", got, app.views.Load())
+	}
+
+	for _, args := range [][]string{{"A"}, {"A=-1"}, {}, {"a=5"}} {
+		if code, _, _ := runCLI(append([]string{"set-counts", "-db", path}, args...)...); code != 2 {
+			t.Errorf("set-counts %v: want exit 2, got %d", args, code)
+		}
+	}
+	if code, _, errOut := runCLI("set-counts", "-db", path, "-contest", "missing", "A=1"); code != 1 || !strings.Contains(errOut, "no contest") {
+		t.Errorf("set-counts on an unknown contest: %d %s", code, errOut)
+	}
+	markServing(t, path)
+	if code, _, _ := runCLI("set-counts", "-db", path, "A=1"); code != 1 {
+		t.Fatal("set-counts under a live server should be refused")
+	}
+	stale := time.Now().Add(-time.Hour)
+	os.Chtimes(serverMarkerPath(path), stale, stale)
+	if code, _, errOut := runCLI("set-counts", "-db", path, "A=1"); code != 0 {
+		t.Fatalf("a stale marker should not block: %s", errOut)
+	}
+}
+
+func TestCommandsUseDataDir(t *testing.T) {
+	path := newCommandDB(t)
+	t.Setenv("DATA_DIR", filepath.Dir(path))
+	if code, out, _ := runCLI("stats"); code != 0 || !strings.Contains(out, "A          31") {
+		t.Fatalf("stats without -db should read DATA_DIR: %d %s", code, out)
+	}
+
+	markServing(t, path)
+	if code, _, errOut := runCLI("set-counts", "A=1"); code != 1 || !strings.Contains(errOut, path) {
+		t.Fatalf("set-counts without -db should see the server in DATA_DIR: %d %s", code, errOut)
+	}
+	if code, _, _ := runCLI("migrate", "rollback"); code != 1 {
+		t.Fatal("migrate rollback under a live server should be refused")
+	}
+	if code, _, _ := runCLI("migrate", "status"); code != 0 {
+		t.Fatal("migrate status only reads, it should run under a live server")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ClickEvent struct {
+	Ts      int64 // unix milliseconds
+	Contest string
+	Option  string
+	Client  string // anonymized client
+}
+
+// ClickLog appends every click to the click_events table. Clicks are handed
+// over on a buffered channel and written in batches by a single goroutine so
+// the click path never waits on SQLite. When the buffer is full the event is
+// dropped and counted rather than blocking.
+type ClickLog struct {
+	db       Store
+	config   ClickLogConfig
+	events   chan ClickEvent
+	mu       sync.Mutex // orders Record against Close
+	closed   bool
+	done     chan struct{}
+	finished sync.WaitGroup
+	dropped  atomic.Int64
+	written  atomic.Int64
+}
+
+// startClickLog returns nil when the log is disabled; a nil *ClickLog accepts
+// and ignores events.
+func startClickLog(db Store, config ClickLogConfig) *ClickLog {
+	if config.buffer <= 0 {
+		return nil
+	}
+	if config.batchSize <= 0 {
+		config.batchSize = 1
+	}
+	if config.flushInterval <= 0 {
+		config.flushInterval = time.Second
+	}
+	l := &ClickLog{
+		db:     db,
+		config: config,
+		events: make(chan ClickEvent, config.buffer),
+		done:   make(chan struct{}),
+	}
+	l.finished.Add(1)
+	go l.run()
+	return l
+}
+
+func (l *ClickLog) Record(event ClickEvent) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		// Shutdown drains before closing the log, so this is rare.
+		if l.dropped.Add(1)%1000 == 1 {
+			log.Println("Click log closed, dropped events:", l.dropped.Load())
+		}
+		return
+	}
+	select {
+	case l.events <- event:
+	default:
+		if l.dropped.Add(1)%1000 == 1 {
+			log.Println("Click log buffer full, dropped events:", l.dropped.Load())
+		}
+	}
+}
+
+// Close stops the writer after flushing whatever is already buffered. Events
+// recorded afterwards are dropped and counted.
+func (l *ClickLog) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	close(l.done)
+	l.finished.Wait()
+}
+
+func (l *ClickLog) run() {
+	defer l.finished.Done()
+	ticker := time.NewTicker(l.config.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ClickEvent, 0, l.config.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := l.db.InsertClickEvents(batch); err != nil {
+			log.Println("Error writing click events:", err)
+		} else {
+			l.written.Add(int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event := <-l.events:
+			batch = append(batch, event)
+			if len(batch) >= l.config.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-l.done:
+			for {
+				select {
+				case event := <-l.events:
+					batch = append(batch, event)
+					if len(batch) >= l.config.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func insertClickEvents(db DB, events []ClickEvent) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx,
+		`INSERT INTO click_events(ts, contest, option, client) VALUES (?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		if _, err := stmt.ExecContext(ctx, e.Ts, e.Contest, e.Option, e.Client); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// fetchClicksSinceSnapshot counts the logged clicks of a contest that happened
+// after its most recent snapshot, so totals can be rebuilt after a crash.
+// Snapshots have second resolution, so clicks in the same second as the
+// snapshot are skipped rather than risk counting them twice.
+func fetchClicksSinceSnapshot(db DB, contest string) (map[string]int64, error) {
+	rows, err := db.Query(`
+		SELECT option, COUNT(*)
+		FROM   click_events
+		WHERE  contest = ?
+		AND    ts >= (COALESCE((SELECT MAX(ts) FROM `+allSnapshots+` WHERE contest = ?), -1) + 1) * 1000
+		GROUP  BY option`, contest, contest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clicks := make(map[string]int64)
+	for rows.Next() {
+		var option string
+		var n int64
+		if err := rows.Scan(&option, &n); err != nil {
+			return nil, err
+		}
+		clicks[option] = n
+	}
+	return clicks, rows.Err()
+}
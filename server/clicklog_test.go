@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func countClickEvents(t *testing.T, db DB) int64 {
+	t.Helper()
+	var n int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM click_events`).Scan(&n); err != nil {
+		t.Fatalf("count click_events: %v", err)
+	}
+	return n
+}
+
+func TestClickLogWritesBatchesAndFlushesOnClose(t *testing.T) {
+	db := newTestDB(t)
+	clickLog := startClickLog(db, ClickLogConfig{buffer: 100, batchSize: 10, flushInterval: time.Hour})
+
+	app := newTestApp()
+	app.db = db
+	app.clickLog = clickLog
+	for i := 0; i < 25; i++ {
+		app.Click("A", "client-1")
+	}
+	app.Click("B", "client-2")
+	clickLog.Close()
+
+	if got := countClickEvents(t, db); got != 26 {
+		t.Fatalf("click_events: want 26 rows, got %d", got)
+	}
+	var option, client string
+	err := db.QueryRow(`SELECT option, client FROM click_events ORDER BY id DESC LIMIT 1`).Scan(&option, &client)
+	if err != nil || option != "B" || client != "client-2" {
+		t.Fatalf("last event: got %s/%s, err %v", option, client, err)
+	}
+
+	// Closed logs drop and count further clicks instead of blocking
+	app.Click("A", "client-1")
+	if got := clickLog.dropped.Load(); got != 1 || countClickEvents(t, db) != 26 {
+		t.Fatalf("late click: want 1 dropped and 26 rows, got %d dropped", got)
+	}
+}
+
+func TestClickLogCloseDuringClicks(t *testing.T) {
+	db := newTestDB(t)
+	clickLog := startClickLog(db, ClickLogConfig{buffer: 10000, batchSize: 50, flushInterval: time.Hour})
+
+	var recorded atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				clickLog.Record(ClickEvent{Option: "A"})
+				recorded.Add(1)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	clickLog.Close()
+	wg.Wait()
+
+	// Every click was either written or counted as dropped.
+	if got := countClickEvents(t, db) + clickLog.dropped.Load(); got != recorded.Load() {
+		t.Fatalf("want %d clicks accounted for, got %d", recorded.Load(), got)
+	}
+}
+
+func TestClickLogDropsWhenBufferFull(t *testing.T) {
+	clickLog := &ClickLog{events: make(chan ClickEvent, 1), done: make(chan struct{})}
+	clickLog.Record(ClickEvent{Option: "A"})
+	clickLog.Record(ClickEvent{Option: "A"})
+	if got := clickLog.dropped.Load(); got != 1 {
+		t.Fatalf("dropped: want 1, got %d", got)
+	}
+}
+
+func TestNewAppReplaysClicksAfterSnapshot(t *testing.T) {
+	db := newTestDB(t)
+	snapshotTs := time.Now().Add(-time.Minute).Unix()
+	if err := insertSnapshotAt(db, "", snapshotTs, map[string]int64{"A": 10, "B": 4}, 20); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	err := insertClickEvents(db, []ClickEvent{
+		{Ts: snapshotTs*1000 - 500, Option: "A"}, // already in the snapshot
+		{Ts: (snapshotTs + 5) * 1000, Option: "A"},
+		{Ts: (snapshotTs + 6) * 1000, Option: "B"},
+		{Ts: (snapshotTs + 7) * 1000, Option: "B", Contest: "other"},
+	})
+	if err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	clickLog := startClickLog(db, ClickLogConfig{buffer: 1})
+	defer clickLog.Close()
+	app := newApp(db, &Configuration{contest: defaultContest}, &Services{clickLog: clickLog}, nil)
+
+	want := map[string]int64{"A": 11, "B": 5}
+	if got := app.clicks.Snapshot(); !sameCounts(got, want) {
+		t.Fatalf("replayed counters: want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP is the address of the client that made the request. When the
+// direct peer is a trusted proxy (nginx in production) X-Forwarded-For is
+// walked from the right, skipping further trusted proxies, and the first
+// untrusted address is the client. Anything left of that could be forged by
+// the client itself so it is ignored.
+func (config *Configuration) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !config.isTrustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break // garbage, stop trusting the header here
+		}
+		if !config.isTrustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func (config *Configuration) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range config.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDRs,
+// e.g. "127.0.0.1,10.0.0.0/8".
+func parseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy %q: %w", entry, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// anonymizeClient hashes a client address with the configured salt so it can
+// be stored without keeping the address itself.
+func (config *Configuration) anonymizeClient(ip string) string {
+	sum := sha256.Sum256([]byte(config.clientSalt + ip))
+	return hex.EncodeToString(sum[:8])
+}
+
+func randomSalt() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
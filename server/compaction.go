@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Snapshots are written to counter_snapshots at full resolution. As they age
+// the compaction job moves them into rollup_snapshots, first per minute, then
+// per hour, then per day, keeping the last snapshot of each bucket. A snapshot
+// lives in exactly one tier, so reading every tier together gives the whole
+// history; these unions are what history queries select from.
+const (
+	allSnapshots = `(
+		SELECT contest, ts, views FROM counter_snapshots
+		UNION ALL
+		SELECT contest, ts, views FROM rollup_snapshots)`
+	allSnapshotClicks = `(
+		SELECT contest, ts, option, clicks FROM snapshot_clicks
+		UNION ALL
+		SELECT contest, ts, option, clicks FROM rollup_clicks)`
+)
+
+type snapshotTier struct {
+	name        string // "" for the raw tables
+	width       int64  // bucket size in seconds
+	snapshots   string
+	clicks      string
+	tierFilter  string
+	retentionOf func(CompactionConfig) time.Duration
+}
+
+var snapshotTiers = []snapshotTier{
+	{"", 1, "counter_snapshots", "snapshot_clicks", "",
+		func(c CompactionConfig) time.Duration { return c.rawRetention }},
+	{"minute", 60, "rollup_snapshots", "rollup_clicks", "tier = 'minute' AND ",
+		func(c CompactionConfig) time.Duration { return c.minuteRetention }},
+	{"hour", 60 * 60, "rollup_snapshots", "rollup_clicks", "tier = 'hour' AND ",
+		func(c CompactionConfig) time.Duration { return c.hourRetention }},
+	{"day", 24 * 60 * 60, "rollup_snapshots", "rollup_clicks", "tier = 'day' AND ",
+		func(c CompactionConfig) time.Duration { return c.dayRetention }},
+}
+
+func (app *App) compactPeriodically() {
+	config := app.configuration.compaction
+	if config.interval <= 0 {
+		return
+	}
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		ticker := time.NewTicker(config.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			moved, err := app.db.Compact(config, time.Now())
+			if err != nil {
+				log.Println("Error compacting snapshots:", err)
+				continue
+			}
+			if moved > 0 {
+				log.Println("compacted", moved, "snapshots")
+			}
+		}
+	}()
+}
+
+// compactSnapshots rolls every tier whose retention has passed into the next,
+// coarser tier and drops day rollups older than their retention, apart from
+// each contest's latest snapshot. A zero
+// retention keeps a tier forever. It returns the number of snapshots that
+// were rolled up or dropped.
+func compactSnapshots(db DB, config CompactionConfig, now time.Time) (int64, error) {
+	var moved int64
+	for i, src := range snapshotTiers {
+		retention := src.retentionOf(config)
+		if retention <= 0 {
+			continue
+		}
+		var n int64
+		var err error
+		if i+1 < len(snapshotTiers) {
+			dst := snapshotTiers[i+1]
+			cutoff := alignDown(now.Add(-retention).Unix(), dst.width)
+			n, err = rollUp(db, src, dst, cutoff)
+		} else {
+			n, err = expire(db, src, now.Add(-retention).Unix())
+		}
+		if err != nil {
+			return moved, fmt.Errorf("tier %q: %w", src.name, err)
+		}
+		moved += n
+	}
+	return moved, nil
+}
+
+// rollUp copies the last snapshot of each dst bucket that ends before cutoff
+// from src into dst, then deletes those src rows. Cutoff is aligned to the
+// dst bucket size so a bucket is always rolled up in one go.
+func rollUp(db DB, src, dst snapshotTier, cutoff int64) (int64, error) {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	lastInBucket := fmt.Sprintf(`(contest, ts) IN (
+		SELECT contest, MAX(ts) FROM %s
+		WHERE  %s ts < ?
+		GROUP  BY contest, ts / %d)`, src.snapshots, src.tierFilter, dst.width)
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT OR REPLACE INTO rollup_snapshots(tier, contest, ts, views)
+		SELECT '%s', contest, ts, views FROM %s
+		WHERE  %s %s`, dst.name, src.snapshots, src.tierFilter, lastInBucket), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT OR REPLACE INTO rollup_clicks(tier, contest, ts, option, clicks)
+		SELECT '%s', contest, ts, option, clicks FROM %s
+		WHERE  %s %s`, dst.name, src.clicks, src.tierFilter, lastInBucket), cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := deleteTierBefore(ctx, tx, src, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// expire deletes snapshots of the last tier older than cutoff, except for the
+// most recent snapshot of each contest which is needed to restore counters.
+func expire(db DB, tier snapshotTier, cutoff int64) (int64, error) {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	notLatest := func(table string) string {
+		return fmt.Sprintf(`ts < (SELECT MAX(ts) FROM %s latest WHERE latest.contest = %s.contest)`,
+			allSnapshots, table)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE %s ts < ? AND %s`, tier.clicks, tier.tierFilter, notLatest(tier.clicks)),
+		cutoff); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE %s ts < ? AND %s`, tier.snapshots, tier.tierFilter, notLatest(tier.snapshots)),
+		cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func deleteTierBefore(ctx context.Context, tx *sql.Tx, tier snapshotTier, cutoff int64) (int64, error) {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE %s ts < ?`, tier.clicks, tier.tierFilter), cutoff); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM %s WHERE %s ts < ?`, tier.snapshots, tier.tierFilter), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func alignDown(ts, width int64) int64 {
+	return ts - ts%width
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func countRows(t *testing.T, db DB, query string, args ...any) int64 {
+	t.Helper()
+	var n int64
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func TestCompactSnapshotsRollsUpOldTiers(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2025, 6, 10, 12, 0, 0, 0, time.UTC)
+
+	// every 10 seconds for the last three hours, clicks == seconds elapsed
+	start := now.Add(-3 * time.Hour).Unix()
+	for ts := start; ts < now.Unix(); ts += 10 {
+		clicks := map[string]int64{"A": ts - start, "B": 1}
+		if err := insertSnapshotAt(db, "", ts, clicks, ts-start); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	before, err := fetchPoints(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CompactionConfig{
+		rawRetention:    time.Hour,     // older than 1h -> per minute
+		minuteRetention: 2 * time.Hour, // older than 2h -> per hour
+	}
+	moved, err := compactSnapshots(db, config, now)
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if moved == 0 {
+		t.Fatal("compact: expected snapshots to move")
+	}
+
+	raw := countRows(t, db, `SELECT COUNT(*) FROM counter_snapshots WHERE ts < ?`, now.Add(-time.Hour).Unix())
+	minutes := countRows(t, db, `SELECT COUNT(*) FROM rollup_snapshots WHERE tier = 'minute'`)
+	hours := countRows(t, db, `SELECT COUNT(*) FROM rollup_snapshots WHERE tier = 'hour'`)
+	if raw != 0 || minutes != 60 || hours != 1 {
+		t.Fatalf("tiers: want 0 old raw / 60 minute / 1 hour rows, got %d / %d / %d", raw, minutes, hours)
+	}
+
+	// history reads across tiers and keeps the last value of each bucket
+	after, err := fetchPoints(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 1+60+360 {
+		t.Fatalf("history: want %d points, got %d", 1+60+360, len(after))
+	}
+	if after[0].Ts != start+3590 || after[0].Clicks["A"] != 3590 {
+		t.Fatalf("hour rollup: want last snapshot of the hour, got %+v", after[0])
+	}
+	if last, prev := after[len(after)-1], before[len(before)-1]; last.Ts != prev.Ts || last.Clicks["A"] != prev.Clicks["A"] {
+		t.Fatalf("latest snapshot changed: %+v vs %+v", last, prev)
+	}
+
+	// running again is a no-op
+	if moved, err := compactSnapshots(db, config, now); err != nil || moved != 0 {
+		t.Fatalf("second compact: moved %d, err %v", moved, err)
+	}
+}
+
+func TestMostRecentSnapshotSurvivesCompaction(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	older := now.Add(-40 * 24 * time.Hour).Unix()
+	if err := insertSnapshotAt(db, "", older, map[string]int64{"A": 1, "B": 1}, 2); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-30 * 24 * time.Hour).Unix()
+	if err := insertSnapshotAt(db, "", old, map[string]int64{"A": 7, "B": 3}, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CompactionConfig{rawRetention: time.Hour, minuteRetention: time.Hour, hourRetention: time.Hour}
+	if _, err := compactSnapshots(db, config, now); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM rollup_snapshots WHERE tier = 'day'`); n != 2 {
+		t.Fatalf("want snapshots in day tier, got %d rows", n)
+	}
+
+	clicks, views := fetchMostRecentSnapshot(db, "")
+	if views != 12 || !sameCounts(clicks, map[string]int64{"A": 7, "B": 3}) {
+		t.Fatalf("most recent snapshot: got %v / %d", clicks, views)
+	}
+
+	config.dayRetention = 24 * time.Hour
+	if _, err := compactSnapshots(db, config, now); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM rollup_clicks`); n != 2 {
+		t.Fatalf("day retention: want only the latest snapshot kept, got %d click rows", n)
+	}
+	clicks, views = fetchMostRecentSnapshot(db, "")
+	if views != 12 || !sameCounts(clicks, map[string]int64{"A": 7, "B": 3}) {
+		t.Fatalf("most recent snapshot after expiry: got %v / %d", clicks, views)
+	}
+}
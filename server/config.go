@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,12 +17,145 @@ import (
 
 type Configuration struct {
 	port              string
-	pprofEnabled      bool
-	pprofPort         string
+	internalAddr      string // pprof, expvar, /readyz and /admin, empty disables
+	internalPublic    bool   // allow internalAddr to be reachable from other hosts
+	websocketEnabled  bool
+	metricsAddr       string
 	snapshotInterval  time.Duration
 	broadcastInterval time.Duration
+	streamInterval    time.Duration
+	feedReplay        int // points kept for /metrics/feed reconnects
+	feedPolicy        SlowConsumerPolicy
+	streamPolicy      SlowConsumerPolicy
+	shutdownTimeout   time.Duration
+	contest           ContestDefinition
+	contests          ContestLimits
+	clientSalt        string
+	trustedProxies    []netip.Prefix
+	clickRate         float64
+	clickBurst        int
+	clickLog          ClickLogConfig
+	compaction        CompactionConfig
+	milestones        MilestoneConfig
+	backups           BackupConfig
+	peers             PeerConfig
+	dataDir           string // database and backups, see dbPath and backupDir
+	siteDir           string // serve templates and assets from here instead of the binary
+	adminToken        string // empty disables /admin
 }
 
+// PeerConfig lists the other nodes serving the main contest. No urls means
+// the node runs alone.
+type PeerConfig struct {
+	node     string   // this node's id, unique among its peers
+	urls     []string // e.g. http://10.0.0.2:8080
+	interval time.Duration
+	secret   string // bearer token peers must send, required with urls
+}
+
+func (peers PeerConfig) enabled() bool {
+	return len(peers.urls) > 0
+}
+
+// BackupConfig schedules backups of the database and how many are kept. A
+// zero interval only backs up at startup.
+type BackupConfig struct {
+	interval   time.Duration
+	keepHourly int
+	keepDaily  int
+	keepWeekly int
+	sink       BackupSinkConfig
+}
+
+// BackupSinkConfig picks where backups are copied besides data/backups:
+// "local" or "gzip" for another directory, "s3" for an object store.
+type BackupSinkConfig struct {
+	kind string
+	dir  string
+	s3   S3Config
+}
+
+type S3Config struct {
+	endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+// MilestoneConfig decides which clicks are notable. counts are exact totals,
+// every marks round numbers (0 disables it) and taking the lead only counts
+// once an option has at least leadMin clicks (0 disables it).
+type MilestoneConfig struct {
+	counts  []int64
+	every   int64
+	leadMin int64
+	secret  string
+	ttl     time.Duration
+}
+
+// CompactionConfig sets how long snapshots stay in each tier before they are
+// rolled into the next, coarser one. A zero retention keeps that tier forever
+// and a zero interval disables compaction.
+type CompactionConfig struct {
+	interval        time.Duration
+	rawRetention    time.Duration
+	minuteRetention time.Duration
+	hourRetention   time.Duration
+	dayRetention    time.Duration
+}
+
+// ClickLogConfig sizes the buffered writer behind the click_events table. A
+// zero buffer disables the log.
+type ClickLogConfig struct {
+	buffer        int
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// ContestLimits bound how many user created contests exist and how long an
+// idle one is kept.
+type ContestLimits struct {
+	perClient       int
+	perClientWindow time.Duration
+	max             int
+	idleTTL         time.Duration
+}
+
+// ContestDefinition describes what the main contest looks like: the greeting
+// shown under the title and the buttons on offer.
+type ContestDefinition struct {
+	Greeting string   `json:"greeting"`
+	Options  []Option `json:"options"`
+}
+
+type Option struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Emoji string `json:"emoji,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// DisplayName is the button text, e.g. "🐕 (Dog)".
+func (o Option) DisplayName() string {
+	if o.Emoji == "" {
+		return o.Label
+	}
+	return o.Emoji + " (" + o.Label + ")"
+}
+
+var defaultContest = ContestDefinition{
+	Greeting: "Choose your favorite!",
+	Options: []Option{
+		{ID: "A", Label: "Dog", Emoji: "🐕", Color: "#8be9fd"},
+		{ID: "B", Label: "Cat", Emoji: "🐈", Color: "#ff7fa3"},
+	},
+}
+
+// Colors handed out to options that don't pick their own.
+var optionPalette = []string{"#8be9fd", "#ff7fa3", "#ffd97d", "#57bdf4", "#b19cd9", "#77dd77"}
+
 func getConfiguration() *Configuration {
 	err := godotenv.Load()
 	if err != nil {
@@ -24,30 +163,372 @@ func getConfiguration() *Configuration {
 		return nil
 	}
 
-	si := os.Getenv("SNAPSHOT_INTERVAL")
-	snapshotInterval, err := time.ParseDuration(si)
+	contest, err := loadContestDefinition(os.Getenv("CONTEST_CONFIG"))
 	if err != nil {
-		fmt.Printf("Invalid SNAPSHOT_INTERVAL=%q, defaulting to 0: %v\n", si, err)
-		snapshotInterval = 0
+		fmt.Printf("Invalid contest definition, defaulting to Dog/Cat: %v\n", err)
+		contest = defaultContest
+	}
+
+	clientSalt := os.Getenv("CLIENT_HASH_SALT")
+	if clientSalt == "" {
+		fmt.Println("CLIENT_HASH_SALT not set, client hashes will change on restart")
+		clientSalt = randomSalt()
 	}
 
-	bi := os.Getenv("BROADCAST_INTERVAL")
-	broadcastInterval, err := time.ParseDuration(bi)
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
 	if err != nil {
-		fmt.Printf("Invalid BROADCAST_INTERVAL=%q, defaulting to 0: %v\n", bi, err)
-		broadcastInterval = 0
+		fmt.Println("Invalid TRUSTED_PROXIES, trusting no proxies:", err)
+		trustedProxies = nil
+	}
+
+	node := os.Getenv("NODE_ID")
+	if node == "" {
+		hostname, _ := os.Hostname()
+		node = hostname + ":" + os.Getenv("PORT")
 	}
 
 	config := Configuration{
 		port:              os.Getenv("PORT"),
-		pprofEnabled:      strings.ToLower(os.Getenv("PPROF_ENABLED")) == "true",
-		pprofPort:         os.Getenv("PPROF_PORT"),
-		snapshotInterval:  snapshotInterval,
-		broadcastInterval: broadcastInterval,
+		internalAddr:      internalAddrFromEnv(),
+		internalPublic:    strings.ToLower(os.Getenv("INTERNAL_ADDR_PUBLIC")) == "true",
+		websocketEnabled:  strings.ToLower(os.Getenv("WEBSOCKET_ENABLED")) == "true",
+		metricsAddr:       os.Getenv("METRICS_ADDR"),
+		snapshotInterval:  durationFromEnv("SNAPSHOT_INTERVAL", 0),
+		broadcastInterval: durationFromEnv("BROADCAST_INTERVAL", 0),
+		streamInterval:    durationFromEnv("STREAM_INTERVAL", defaultStreamInterval),
+		feedReplay:        intFromEnv("FEED_REPLAY", 600),
+		feedPolicy:        policyFromEnv("FEED_SLOW_POLICY", policyDropOldest),
+		streamPolicy:      policyFromEnv("STREAM_SLOW_POLICY", policyCoalesce),
+		shutdownTimeout:   durationFromEnv("SHUTDOWN_TIMEOUT", 10*time.Second),
+		contest:           contest,
+		contests: ContestLimits{
+			perClient:       intFromEnv("CONTEST_LIMIT_PER_CLIENT", 3),
+			perClientWindow: durationFromEnv("CONTEST_LIMIT_WINDOW", 24*time.Hour),
+			max:             intFromEnv("CONTEST_MAX", 1000),
+			idleTTL:         durationFromEnv("CONTEST_IDLE_TTL", 7*24*time.Hour),
+		},
+		clientSalt:     clientSalt,
+		trustedProxies: trustedProxies,
+		clickRate:      floatFromEnv("CLICK_RATE", 10),
+		clickBurst:     intFromEnv("CLICK_BURST", 20),
+		clickLog: ClickLogConfig{
+			buffer:        intFromEnv("CLICK_LOG_BUFFER", 10000),
+			batchSize:     intFromEnv("CLICK_LOG_BATCH", 500),
+			flushInterval: durationFromEnv("CLICK_LOG_FLUSH_INTERVAL", time.Second),
+		},
+		compaction: CompactionConfig{
+			interval:        durationFromEnv("COMPACTION_INTERVAL", 10*time.Minute),
+			rawRetention:    durationFromEnv("SNAPSHOT_RAW_RETENTION", 48*time.Hour),
+			minuteRetention: durationFromEnv("SNAPSHOT_MINUTE_RETENTION", 14*24*time.Hour),
+			hourRetention:   durationFromEnv("SNAPSHOT_HOUR_RETENTION", 180*24*time.Hour),
+			dayRetention:    durationFromEnv("SNAPSHOT_DAY_RETENTION", 0),
+		},
+		milestones: MilestoneConfig{
+			counts:  countsFromEnv("MILESTONES", []int64{1000, 10000, 100000, 1000000}),
+			every:   int64(intFromEnv("MILESTONE_EVERY", 0)),
+			leadMin: int64(intFromEnv("MILESTONE_LEAD_MIN", 100)),
+			secret:  os.Getenv("MILESTONE_SECRET"),
+			ttl:     durationFromEnv("MILESTONE_TTL", 10*time.Minute),
+		},
+		backups: BackupConfig{
+			interval:   durationFromEnv("BACKUP_INTERVAL", time.Hour),
+			keepHourly: intFromEnv("BACKUP_KEEP_HOURLY", 24),
+			keepDaily:  intFromEnv("BACKUP_KEEP_DAILY", 7),
+			keepWeekly: intFromEnv("BACKUP_KEEP_WEEKLY", 4),
+			sink: BackupSinkConfig{
+				kind: strings.ToLower(os.Getenv("BACKUP_SINK")),
+				dir:  os.Getenv("BACKUP_SINK_DIR"),
+				s3: S3Config{
+					endpoint:  os.Getenv("S3_ENDPOINT"),
+					region:    os.Getenv("S3_REGION"),
+					bucket:    os.Getenv("S3_BUCKET"),
+					prefix:    os.Getenv("S3_PREFIX"),
+					accessKey: os.Getenv("S3_ACCESS_KEY"),
+					secretKey: os.Getenv("S3_SECRET_KEY"),
+				},
+			},
+		},
+		peers: PeerConfig{
+			node:     node,
+			urls:     listFromEnv("PEERS"),
+			interval: durationFromEnv("PEER_SYNC_INTERVAL", time.Second),
+			secret:   os.Getenv("PEER_SECRET"),
+		},
+		dataDir:    os.Getenv("DATA_DIR"),
+		siteDir:    os.Getenv("SITE_DIR"),
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+	}
+	if config.peers.interval <= 0 {
+		config.peers.interval = time.Second
 	}
 	return &config
 }
 
+// validate refuses settings the server must not start with.
+func (config *Configuration) validate() error {
+	if config.peers.enabled() && config.peers.secret == "" {
+		return errors.New("PEERS is set without PEER_SECRET, anyone could add clicks that can't be taken back")
+	}
+	if config.adminToken != "" && config.internalAddr == "" {
+		return errors.New("ADMIN_TOKEN is set without INTERNAL_ADDR, the admin console is only served there")
+	}
+	if config.internalAddr != "" && !config.internalPublic && !isLoopbackAddr(config.internalAddr) {
+		return fmt.Errorf("INTERNAL_ADDR %q is reachable from other hosts, use a loopback address or set INTERNAL_ADDR_PUBLIC=true", config.internalAddr)
+	}
+	return nil
+}
+
+// isLoopbackAddr reports whether a listen address like 127.0.0.1:6060 only
+// accepts local connections. An empty host listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		fmt.Printf("Invalid %s=%q, defaulting to %v: %v\n", key, raw, fallback, err)
+		return fallback
+	}
+	return d
+}
+
+// internalAddrFromEnv reads INTERNAL_ADDR. The older PPROF_ENABLED and
+// PPROF_PORT still work and become a loopback address on that port.
+func internalAddrFromEnv() string {
+	if addr := os.Getenv("INTERNAL_ADDR"); addr != "" {
+		return addr
+	}
+	if strings.ToLower(os.Getenv("PPROF_ENABLED")) == "true" && os.Getenv("PPROF_PORT") != "" {
+		fmt.Println("PPROF_ENABLED and PPROF_PORT are deprecated, use INTERNAL_ADDR")
+		return "127.0.0.1:" + os.Getenv("PPROF_PORT")
+	}
+	return ""
+}
+
+// policyFromEnv reads a SlowConsumerPolicy mode; disconnect gives up on a
+// subscriber after SLOW_CLIENT_MAX_DROPS values in a row.
+func policyFromEnv(key string, fallback string) SlowConsumerPolicy {
+	mode := strings.ToLower(os.Getenv(key))
+	switch mode {
+	case "":
+		mode = fallback
+	case policyDropOldest, policyCoalesce, policyDisconnect:
+	default:
+		fmt.Printf("Invalid %s=%q, defaulting to %s\n", key, mode, fallback)
+		mode = fallback
+	}
+	return SlowConsumerPolicy{mode: mode, maxDrops: intFromEnv("SLOW_CLIENT_MAX_DROPS", 50)}
+}
+
+func floatFromEnv(key string, fallback float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		fmt.Printf("Invalid %s=%q, defaulting to %g: %v\n", key, raw, fallback, err)
+		return fallback
+	}
+	return f
+}
+
+func intFromEnv(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		fmt.Printf("Invalid %s=%q, defaulting to %d: %v\n", key, raw, fallback, err)
+		return fallback
+	}
+	return n
+}
+
+// listFromEnv reads a comma separated list, skipping empty entries.
+func listFromEnv(key string) []string {
+	var list []string
+	for _, field := range strings.Split(os.Getenv(key), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
+}
+
+// countsFromEnv reads a comma separated list of positive integers.
+func countsFromEnv(key string, fallback []int64) []int64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	var counts []int64
+	for _, field := range strings.Split(raw, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil || n <= 0 {
+			fmt.Printf("Invalid %s=%q, defaulting to %v\n", key, raw, fallback)
+			return fallback
+		}
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+// loadContestDefinition reads the contest definition from a json file (see
+// contest.example.json), then applies env overrides:
+//
+//	GREETING                      replaces the greeting
+//	OPTIONS=A:Dog,B:Cat,C         replaces the option list
+//	OPTION_<ID>_LABEL / _EMOJI / _COLOR   adjust a single option
+//
+// A missing file is not an error; the Dog/Cat defaults are used instead.
+func loadContestDefinition(path string) (ContestDefinition, error) {
+	if path == "" {
+		path = contestConfigPath
+	}
+	contest := ContestDefinition{
+		Greeting: defaultContest.Greeting,
+		Options:  append([]Option(nil), defaultContest.Options...),
+	}
+
+	raw, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var fromFile ContestDefinition
+		if err := json.Unmarshal(raw, &fromFile); err != nil {
+			return ContestDefinition{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if fromFile.Greeting != "" {
+			contest.Greeting = fromFile.Greeting
+		}
+		if len(fromFile.Options) != 0 {
+			contest.Options = fromFile.Options
+		}
+	case !os.IsNotExist(err):
+		return ContestDefinition{}, err
+	}
+
+	if greeting := os.Getenv("GREETING"); greeting != "" {
+		contest.Greeting = greeting
+	}
+	if raw := os.Getenv("OPTIONS"); strings.TrimSpace(raw) != "" {
+		contest.Options = parseOptions(raw)
+	}
+	for i := range contest.Options {
+		o := &contest.Options[i]
+		prefix := "OPTION_" + strings.ToUpper(o.ID) + "_"
+		if v := os.Getenv(prefix + "LABEL"); v != "" {
+			o.Label = v
+		}
+		if v := os.Getenv(prefix + "EMOJI"); v != "" {
+			o.Emoji = v
+		}
+		if v := os.Getenv(prefix + "COLOR"); v != "" {
+			o.Color = v
+		}
+	}
+
+	if err := contest.validate(); err != nil {
+		return ContestDefinition{}, err
+	}
+	contest.fillColors()
+	return contest, nil
+}
+
+// parseOptions reads a comma separated list of id:label pairs, e.g.
+// "A:Dog,B:Cat,C:Fish". A missing label defaults to the id.
+func parseOptions(raw string) []Option {
+	var options []Option
+	for _, entry := range strings.Split(raw, ",") {
+		id, label, _ := strings.Cut(entry, ":")
+		id, label = strings.TrimSpace(id), strings.TrimSpace(label)
+		if label == "" {
+			label = id
+		}
+		options = append(options, Option{ID: id, Label: label})
+	}
+	return options
+}
+
+// validate checks the options can be used in urls, signals, css and the db:
+// ids are letters, digits and underscores and colors are hex codes. Ids may
+// not differ only by case, since they would share OPTION_<ID>_* overrides.
+func (contest ContestDefinition) validate() error {
+	if len(contest.Options) < 2 {
+		return fmt.Errorf("need at least two options, got %d", len(contest.Options))
+	}
+	seen := make(map[string]string)
+	for _, o := range contest.Options {
+		if !validOptionID(o.ID) {
+			return fmt.Errorf("invalid option id %q", o.ID)
+		}
+		if other, ok := seen[strings.ToUpper(o.ID)]; ok {
+			if other == o.ID {
+				return fmt.Errorf("duplicate option id %q", o.ID)
+			}
+			return fmt.Errorf("option ids %q and %q differ only by case", other, o.ID)
+		}
+		seen[strings.ToUpper(o.ID)] = o.ID
+		if strings.TrimSpace(o.Label) == "" {
+			return fmt.Errorf("option %q has no label", o.ID)
+		}
+		if o.Color != "" && !validColor(o.Color) {
+			return fmt.Errorf("option %q has invalid color %q", o.ID, o.Color)
+		}
+	}
+	return nil
+}
+
+func (contest *ContestDefinition) fillColors() {
+	for i := range contest.Options {
+		if contest.Options[i].Color == "" {
+			contest.Options[i].Color = optionPalette[i%len(optionPalette)]
+		}
+	}
+}
+
+func validColor(color string) bool {
+	if !strings.HasPrefix(color, "#") {
+		return false
+	}
+	hex := color[1:]
+	if len(hex) != 3 && len(hex) != 6 {
+		return false
+	}
+	for _, r := range hex {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func validOptionID(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 func (config *Configuration) snapshotEnabled() bool {
 	return config.snapshotInterval != 0
 }
@@ -55,3 +536,19 @@ func (config *Configuration) snapshotEnabled() bool {
 func (config *Configuration) broadcastEnabled() bool {
 	return config.broadcastInterval != 0
 }
+
+// dbPath and backupDir default to data/ in the working directory; DATA_DIR
+// moves both, e.g. to run several nodes from one checkout.
+func (config *Configuration) dbPath() string {
+	if config.dataDir == "" {
+		return dbFilePath
+	}
+	return filepath.Join(config.dataDir, "clicks.db")
+}
+
+func (config *Configuration) backupDir() string {
+	if config.dataDir == "" {
+		return backupDirectory
+	}
+	return filepath.Join(config.dataDir, "backups")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadContestDefinitionDefaults(t *testing.T) {
+	contest, err := loadContestDefinition(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if contest.Greeting != defaultContest.Greeting || len(contest.Options) != 2 {
+		t.Fatalf("want defaults, got %+v", contest)
+	}
+	if got := contest.Options[0].DisplayName(); got != "🐕 (Dog)" {
+		t.Errorf("display name: want %q, got %q", "🐕 (Dog)", got)
+	}
+}
+
+func TestLoadContestDefinitionFileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contest.json")
+	err := os.WriteFile(path, []byte(`{
+		"greeting": "Pick a snack",
+		"options": [
+			{"id": "chips", "label": "Chips", "emoji": "🥔", "color": "#ffcc00"},
+			{"id": "fruit", "label": "Fruit"},
+			{"id": "cake", "label": "Cake"}
+		]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GREETING", "Snack time")
+	t.Setenv("OPTION_FRUIT_EMOJI", "🍎")
+
+	contest, err := loadContestDefinition(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if contest.Greeting != "Snack time" {
+		t.Errorf("greeting: want env override, got %q", contest.Greeting)
+	}
+	if len(contest.Options) != 3 || contest.Options[1].DisplayName() != "🍎 (Fruit)" {
+		t.Fatalf("options: unexpected %+v", contest.Options)
+	}
+	if contest.Options[0].Color != "#ffcc00" || contest.Options[2].Color == "" {
+		t.Errorf("colors: want configured and palette colors, got %+v", contest.Options)
+	}
+}
+
+func TestLoadContestDefinitionOptionsEnv(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.json")
+
+	t.Setenv("OPTIONS", "A:Dog, B:Cat,C")
+	contest, err := loadContestDefinition(missing)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := []string{"Dog", "Cat", "C"}
+	for i, o := range contest.Options {
+		if o.Label != want[i] {
+			t.Fatalf("labels: want %v, got %+v", want, contest.Options)
+		}
+	}
+
+	for _, bad := range []string{"A", "A,A", "a,A", "A,b-c", "A,:label"} {
+		t.Setenv("OPTIONS", bad)
+		if _, err := loadContestDefinition(missing); err == nil {
+			t.Errorf("OPTIONS=%q: want error", bad)
+		}
+	}
+
+	t.Setenv("OPTIONS", "")
+	t.Setenv("OPTION_A_COLOR", "red;background:url(x)")
+	if _, err := loadContestDefinition(missing); err == nil {
+		t.Error("invalid color: want error")
+	}
+}
+
+func TestGreetingWithApostropheRenders(t *testing.T) {
+	t.Setenv("GREETING", "Let's click")
+	contest, err := loadContestDefinition(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp()
+	app.configuration.contest = contest
+
+	rr := httptest.NewRecorder()
+	app.homeHandler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if sig := pageSignals(t, rr.Body.String()); sig.Message != "Let's click" {
+		t.Fatalf("greeting: got %q", sig.Message)
+	}
+}
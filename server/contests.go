@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	contestMaxOptions     = 10
+	contestMaxTitleLen    = 80
+	contestMaxLabelLen    = 40
+	contestSweepInterval  = time.Minute
+	contestCreateBodySize = 4 << 10
+)
+
+var (
+	errContestLimit    = errors.New("contest limit reached")
+	errContestCapacity = errors.New("no room for new contests")
+)
+
+// Contest is a user created contest served under /c/{slug}.
+type Contest struct {
+	Slug      string
+	Title     string
+	Options   []Option
+	Creator   string // anonymized client
+	CreatedAt int64
+}
+
+type contestEntry struct {
+	app     *App
+	handler http.Handler
+}
+
+// Contests keeps every live user contest in memory, each backed by its own
+// App so counters, streams and snapshots work exactly like the main contest.
+type Contests struct {
+	sync.Mutex
+	db       Store
+	config   *Configuration
+	services *Services
+	bySlug   map[string]*contestEntry
+	creating sync.Mutex // one create at a time, so the limits hold
+	done     chan struct{}
+	workers  sync.WaitGroup // the expiry sweep, stopped by done
+}
+
+func NewContests(db Store, config *Configuration, services *Services) *Contests {
+	return &Contests{
+		db:       db,
+		config:   config,
+		services: services,
+		bySlug:   make(map[string]*contestEntry),
+		done:     make(chan struct{}),
+	}
+}
+
+// loadContests restores the contests stored in the db and starts their
+// background jobs.
+func loadContests(db Store, config *Configuration, services *Services) *Contests {
+	contests := NewContests(db, config, services)
+	stored, err := db.Contests()
+	if err != nil {
+		log.Fatalf("load contests: %v", err)
+	}
+	for _, c := range stored {
+		contests.start(c.contest, c.lastActive)
+	}
+	log.Println("loaded", len(stored), "contests")
+	return contests
+}
+
+func (contests *Contests) start(contest *Contest, lastActive int64) *App {
+	config := *contests.config
+	config.contest = ContestDefinition{Greeting: contest.Title, Options: contest.Options}
+	app := newApp(contests.db, &config, contests.services, contest)
+	if lastActive != 0 {
+		app.lastActive.Store(lastActive)
+	}
+	app.takePeriodicSnapshots()
+	app.sendPeriodicBroadcasts()
+	app.publishCounterChanges()
+
+	mux := http.NewServeMux()
+	app.registerContestRoutes(mux)
+
+	contests.Lock()
+	contests.bySlug[contest.Slug] = &contestEntry{
+		app:     app,
+		handler: http.StripPrefix("/c/"+contest.Slug, mux),
+	}
+	contests.Unlock()
+	return app
+}
+
+func (contests *Contests) get(slug string) *App {
+	contests.Lock()
+	defer contests.Unlock()
+	if entry, ok := contests.bySlug[slug]; ok {
+		return entry.app
+	}
+	return nil
+}
+
+// apps returns the apps of every live contest.
+func (contests *Contests) apps() []*App {
+	contests.Lock()
+	defer contests.Unlock()
+	apps := make([]*App, 0, len(contests.bySlug))
+	for _, entry := range contests.bySlug {
+		apps = append(apps, entry.app)
+	}
+	return apps
+}
+
+func (contests *Contests) count() int {
+	contests.Lock()
+	defer contests.Unlock()
+	return len(contests.bySlug)
+}
+
+// create validates and stores a new contest, then starts serving it.
+func (contests *Contests) create(title string, labels []string, creator string) (*App, error) {
+	// The limits are checked against counts that only change once the
+	// contest is stored and started, so the whole create is serialized.
+	contests.creating.Lock()
+	defer contests.creating.Unlock()
+
+	limits := contests.config.contests
+	if limits.max > 0 && contests.count() >= limits.max {
+		return nil, errContestCapacity
+	}
+	if limits.perClient > 0 {
+		since := time.Now().Add(-limits.perClientWindow).Unix()
+		n, err := contests.db.CountContestsBy(creator, since)
+		if err != nil {
+			return nil, err
+		}
+		if n >= limits.perClient {
+			return nil, errContestLimit
+		}
+	}
+
+	contest := &Contest{
+		Title:     title,
+		Options:   contestOptions(labels),
+		Creator:   creator,
+		CreatedAt: time.Now().Unix(),
+	}
+	for attempt := 0; ; attempt++ {
+		contest.Slug = newSlug()
+		err := contests.db.InsertContest(contest)
+		if err == nil {
+			break
+		}
+		if attempt == 2 {
+			return nil, err
+		}
+	}
+	return contests.start(contest, 0), nil
+}
+
+// contestOptions gives user supplied labels the ids A, B, C... and colors
+// from the palette.
+func contestOptions(labels []string) []Option {
+	options := make([]Option, len(labels))
+	for i, label := range labels {
+		options[i] = Option{
+			ID:    string(rune('A' + i)),
+			Label: label,
+			Color: optionPalette[i%len(optionPalette)],
+		}
+	}
+	return options
+}
+
+func newSlug() string {
+	b := make([]byte, 5)
+	_, _ = rand.Read(b)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// ---------- Expiry -------------
+
+// expireIdleContests periodically saves the activity of each contest and drops
+// the ones that have been idle for longer than the configured ttl.
+func (contests *Contests) expireIdleContests() {
+	if contests.config.contests.idleTTL <= 0 {
+		return
+	}
+	contests.workers.Add(1)
+	go func() {
+		defer contests.workers.Done()
+		ticker := time.NewTicker(contestSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-contests.done:
+				return
+			case <-ticker.C:
+				contests.sweep(time.Now())
+			}
+		}
+	}()
+}
+
+func (contests *Contests) sweep(now time.Time) {
+	cutoff := now.Add(-contests.config.contests.idleTTL).Unix()
+
+	contests.Lock()
+	var idle []*contestEntry
+	active := make(map[string]int64, len(contests.bySlug))
+	for slug, entry := range contests.bySlug {
+		lastActive := entry.app.lastActive.Load()
+		if lastActive < cutoff {
+			idle = append(idle, entry)
+			delete(contests.bySlug, slug)
+			continue
+		}
+		active[slug] = lastActive
+	}
+	contests.Unlock()
+
+	for slug, lastActive := range active {
+		if err := contests.db.UpdateContestActivity(slug, lastActive); err != nil {
+			log.Println("Error saving contest activity:", err)
+		}
+	}
+	for _, entry := range idle {
+		entry.app.close()
+		if err := contests.db.DeleteContest(entry.app.slug()); err != nil {
+			log.Println("Error deleting idle contest:", err)
+			continue
+		}
+		log.Println("expired idle contest", entry.app.slug())
+	}
+}
+
+// ---------- Handlers -------------
+
+type createContestRequest struct {
+	Title   string   `json:"title"`
+	Options []string `json:"options"`
+}
+
+type createContestResponse struct {
+	Slug string `json:"slug"`
+	URL  string `json:"url"`
+}
+
+func (contests *Contests) createHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req createContestRequest
+	body := http.MaxBytesReader(w, r.Body, contestCreateBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	title, labels, err := validateContest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	app, err := contests.create(title, labels, contests.config.anonymizeClient(contests.config.clientIP(r)))
+	switch {
+	case errors.Is(err, errContestLimit):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case errors.Is(err, errContestCapacity):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Println("Error creating contest:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	url := "/c/" + app.slug()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createContestResponse{Slug: app.slug(), URL: url})
+}
+
+func validateContest(req createContestRequest) (string, []string, error) {
+	title := strings.TrimSpace(req.Title)
+	if title == "" || utf8.RuneCountInString(title) > contestMaxTitleLen {
+		return "", nil, fmt.Errorf("title must be 1-%d characters", contestMaxTitleLen)
+	}
+	if len(req.Options) < 2 || len(req.Options) > contestMaxOptions {
+		return "", nil, fmt.Errorf("contests need 2-%d options", contestMaxOptions)
+	}
+	labels := make([]string, len(req.Options))
+	for i, label := range req.Options {
+		label = strings.TrimSpace(label)
+		if label == "" || utf8.RuneCountInString(label) > contestMaxLabelLen {
+			return "", nil, fmt.Errorf("option labels must be 1-%d characters", contestMaxLabelLen)
+		}
+		labels[i] = label
+	}
+	return title, labels, nil
+}
+
+func (contests *Contests) contestHandler(w http.ResponseWriter, r *http.Request) {
+	contests.Lock()
+	entry, ok := contests.bySlug[r.PathValue("slug")]
+	contests.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	entry.handler.ServeHTTP(w, r)
+}
+
+// ---------- Storage -------------
+
+type storedContest struct {
+	contest    *Contest
+	lastActive int64
+}
+
+func insertContest(db DB, contest *Contest) error {
+	options, err := json.Marshal(contest.Options)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(context.Background(),
+		`INSERT INTO contests(slug, title, options, creator, created_at, last_active)
+		VALUES (?,?,?,?,?,?)`,
+		contest.Slug, contest.Title, string(options), contest.Creator, contest.CreatedAt, contest.CreatedAt)
+	return err
+}
+
+func fetchContests(db DB) ([]storedContest, error) {
+	rows, err := db.Query(`SELECT slug, title, options, creator, created_at, last_active FROM contests`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []storedContest
+	for rows.Next() {
+		var c Contest
+		var options string
+		var lastActive int64
+		if err := rows.Scan(&c.Slug, &c.Title, &options, &c.Creator, &c.CreatedAt, &lastActive); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(options), &c.Options); err != nil {
+			return nil, fmt.Errorf("contest %s options: %w", c.Slug, err)
+		}
+		out = append(out, storedContest{contest: &c, lastActive: lastActive})
+	}
+	return out, rows.Err()
+}
+
+func countContestsBy(db DB, creator string, since int64) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM contests WHERE creator = ? AND created_at >= ?`,
+		creator, since).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
+
+func updateContestActivity(db DB, slug string, lastActive int64) error {
+	_, err := db.ExecContext(context.Background(),
+		`UPDATE contests SET last_active = ? WHERE slug = ?`, lastActive, slug)
+	return err
+}
+
+// deleteContest removes a contest with all of its snapshots and clicks.
+func deleteContest(db DB, slug string) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`DELETE FROM click_events WHERE contest = ?`,
+		`DELETE FROM snapshot_clicks WHERE contest = ?`,
+		`DELETE FROM counter_snapshots WHERE contest = ?`,
+		`DELETE FROM rollup_clicks WHERE contest = ?`,
+		`DELETE FROM rollup_snapshots WHERE contest = ?`,
+		`DELETE FROM milestones WHERE contest = ?`,
+		`DELETE FROM contests WHERE slug = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, slug); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ---------------------- helpers ----------------------
+
+func newTestContests(t *testing.T, limits ContestLimits) *Contests {
+	t.Helper()
+	return NewContests(newTestDB(t), &Configuration{contest: defaultContest, contests: limits}, &Services{})
+}
+
+func postContest(t *testing.T, contests *Contests, body, remoteAddr string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/contests", strings.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	contests.createHandler(rr, req)
+	return rr
+}
+
+func serveContests(contests *Contests, method, url string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/c/{slug}/", contests.contestHandler)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(method, url, nil))
+	return rr
+}
+
+// ---------------------- create ----------------------
+
+func TestCreateContestServesOwnCounters(t *testing.T) {
+	contests := newTestContests(t, ContestLimits{perClient: 5, perClientWindow: time.Hour})
+
+	rr := postContest(t, contests, `{"title":"Best fruit","options":["Apple","Pear","Plum"]}`, "10.0.0.1:1234")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: want HTTP 201, got %d (%s)", rr.Code, rr.Body.String())
+	}
+	var resp createContestResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("create: invalid json: %v", err)
+	}
+	if resp.URL != "/c/"+resp.Slug || resp.Slug == "" {
+		t.Fatalf("create: unexpected response %+v", resp)
+	}
+
+	for _, option := range []string{"C", "C", "A"} {
+		if rr := serveContests(contests, http.MethodPost, resp.URL+"/click/"+option); rr.Code != http.StatusOK {
+			t.Fatalf("click %s: want HTTP 200, got %d", option, rr.Code)
+		}
+	}
+	if rr := serveContests(contests, http.MethodPost, resp.URL+"/click/D"); rr.Code != http.StatusNotFound {
+		t.Fatalf("click D: want HTTP 404, got %d", rr.Code)
+	}
+
+	app := contests.get(resp.Slug)
+	want := map[string]int64{"A": 1, "B": 0, "C": 2}
+	if got := app.clicks.Snapshot(); !sameCounts(got, want) {
+		t.Fatalf("contest counters: want %v, got %v", want, got)
+	}
+
+	home := serveContests(contests, http.MethodGet, resp.URL+"/")
+	if home.Code != http.StatusOK || !strings.Contains(home.Body.String(), "Pear") {
+		t.Fatalf("contest home: got HTTP %d", home.Code)
+	}
+
+	if rr := serveContests(contests, http.MethodGet, "/c/missing/"); rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown contest: want HTTP 404, got %d", rr.Code)
+	}
+}
+
+func TestConcurrentCreatesRespectLimits(t *testing.T) {
+	for _, limits := range []ContestLimits{
+		{perClient: 2, perClientWindow: time.Hour},
+		{max: 2},
+	} {
+		contests := newTestContests(t, limits)
+		var wg sync.WaitGroup
+		var created atomic.Int64
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := contests.create("Best fruit", []string{"Apple", "Pear"}, "creator"); err == nil {
+					created.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if created.Load() != 2 || contests.count() != 2 {
+			t.Errorf("%+v: want 2 contests, created %d, serving %d", limits, created.Load(), contests.count())
+		}
+		contests.closeAll()
+	}
+}
+
+func TestContestTitleCannotBreakOutOfSignals(t *testing.T) {
+	contests := newTestContests(t, ContestLimits{perClient: 5, perClientWindow: time.Hour})
+	title := `x' autofocus tabindex=1 onfocus=alert(1) y='`
+	rr := postContest(t, contests, `{"title":"`+title+`","options":["Apple","Pear"]}`, "10.0.0.1:1234")
+	var resp createContestResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("create: %v (HTTP %d)", err, rr.Code)
+	}
+
+	home := serveContests(contests, http.MethodGet, resp.URL+"/")
+	if sig := pageSignals(t, home.Body.String()); sig.Message != title {
+		t.Fatalf("title should reach the page as data, got %q", sig.Message)
+	}
+}
+
+func TestCreateContestValidationAndLimits(t *testing.T) {
+	contests := newTestContests(t, ContestLimits{perClient: 2, perClientWindow: time.Hour})
+
+	invalid := []string{
+		`not json`,
+		`{"title":"","options":["a","b"]}`,
+		`{"title":"one option","options":["a"]}`,
+		`{"title":"blank option","options":["a"," "]}`,
+	}
+	for _, body := range invalid {
+		if rr := postContest(t, contests, body, "10.0.0.1:1"); rr.Code != http.StatusBadRequest {
+			t.Errorf("create %s: want HTTP 400, got %d", body, rr.Code)
+		}
+	}
+
+	valid := `{"title":"x","options":["a","b"]}`
+	for i := 0; i < 2; i++ {
+		if rr := postContest(t, contests, valid, "10.0.0.1:1"); rr.Code != http.StatusCreated {
+			t.Fatalf("create %d: want HTTP 201, got %d", i, rr.Code)
+		}
+	}
+	if rr := postContest(t, contests, valid, "10.0.0.1:2"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("create over limit: want HTTP 429, got %d", rr.Code)
+	}
+	if rr := postContest(t, contests, valid, "10.0.0.2:1"); rr.Code != http.StatusCreated {
+		t.Fatalf("create from other client: want HTTP 201, got %d", rr.Code)
+	}
+}
+
+// ---------------------- expiry ----------------------
+
+func TestSweepExpiresIdleContests(t *testing.T) {
+	contests := newTestContests(t, ContestLimits{idleTTL: time.Hour})
+
+	idle, err := contests.create("idle", []string{"a", "b"}, "creator")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	busy, err := contests.create("busy", []string{"a", "b"}, "creator")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := insertSnapshot(contests.db, idle.slug(), map[string]int64{"A": 1}, 1); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	idle.lastActive.Store(time.Now().Add(-2 * time.Hour).Unix())
+	contests.sweep(time.Now())
+
+	if contests.get(idle.slug()) != nil {
+		t.Error("idle contest should have been removed")
+	}
+	if contests.get(busy.slug()) == nil {
+		t.Error("active contest should have been kept")
+	}
+	if pts, _ := fetchPoints(contests.db, idle.slug()); len(pts) != 0 {
+		t.Errorf("idle contest snapshots should be deleted, got %d", len(pts))
+	}
+	stored, _ := contests.db.Contests()
+	if len(stored) != 1 || stored[0].contest.Slug != busy.slug() {
+		t.Errorf("stored contests: want only %s, got %+v", busy.slug(), stored)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Counters holds one click counter per option. The set of options is fixed at
+// construction so lookups need no locking. A replicated Counters also keeps
+// the per node counts behind each total, see Replicate.
+type Counters struct {
+	options []string
+	clicks  map[string]*atomic.Int64
+	replica *GCounter // nil unless peers are configured
+}
+
+func NewCounters(options []string) *Counters {
+	c := &Counters{
+		options: options,
+		clicks:  make(map[string]*atomic.Int64, len(options)),
+	}
+	for _, id := range options {
+		c.clicks[id] = &atomic.Int64{}
+	}
+	return c
+}
+
+func (c *Counters) Options() []string {
+	return c.options
+}
+
+func (c *Counters) Has(option string) bool {
+	_, ok := c.clicks[option]
+	return ok
+}
+
+func (c *Counters) Add(option string, delta int64) (int64, bool) {
+	counter, ok := c.clicks[option]
+	if !ok {
+		return 0, false
+	}
+	if c.replica != nil {
+		c.replica.Lock()
+		defer c.replica.Unlock()
+		c.replica.add(option, delta)
+	}
+	return counter.Add(delta), true
+}
+
+func (c *Counters) Load(option string) int64 {
+	counter, ok := c.clicks[option]
+	if !ok {
+		return 0
+	}
+	return counter.Load()
+}
+
+func (c *Counters) Store(option string, value int64) {
+	if counter, ok := c.clicks[option]; ok {
+		counter.Store(value)
+	}
+}
+
+// Snapshot returns the current count of every option. Counts are read one at
+// a time so the result is not an atomic view across options.
+func (c *Counters) Snapshot() map[string]int64 {
+	out := make(map[string]int64, len(c.options))
+	for _, id := range c.options {
+		out[id] = c.clicks[id].Load()
+	}
+	return out
+}
+
+// StoreAll sets every known option from counts, ignoring unknown options.
+func (c *Counters) StoreAll(counts map[string]int64) {
+	for id, n := range counts {
+		c.Store(id, n)
+	}
+}
+
+func sameCounts(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, n := range a {
+		if m, ok := b[id]; !ok || m != n {
+			return false
+		}
+	}
+	return true
+}
@@ -7,77 +7,117 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+// DB is the SQLite Store the server runs on.
 type DB struct {
 	*sql.DB
 }
 
 // ---------- Startup -------------
 
-func initDB() DB {
-	repoRoot, _ := os.Getwd()
-	dbPath := filepath.Join(repoRoot, filepath.FromSlash(dbFilePath))
+func initDB(config *Configuration) DB {
+	dbPath, _ := filepath.Abs(filepath.FromSlash(config.dbPath()))
+	backupDir, _ := filepath.Abs(filepath.FromSlash(config.backupDir()))
 
-	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
-		log.Fatalf("mkdir data dir: %v", err)
+	if err := ensureHealthyDB(dbPath, backupDir, time.Now()); err != nil {
+		log.Fatal("Refusing to start on a corrupt database: ", err)
 	}
-
-	var err error
-	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_journal_mode=WAL", dbPath))
+	db, err := openDB(dbPath)
 	if err != nil {
-		log.Fatalf("open db: %v", err)
+		log.Fatal(err)
 	}
+	return db
+}
 
-	schemaPath := filepath.Join(repoRoot, filepath.FromSlash(schemaFilePath))
-	schema, err := os.ReadFile(schemaPath)
+// openDB opens the database and applies any pending migrations.
+func openDB(dbPath string) (DB, error) {
+	db, err := openSQLite(dbPath)
 	if err != nil {
-		log.Fatalf("read schema: %v", err)
+		return DB{}, err
 	}
-	if _, err := db.Exec(string(schema)); err != nil {
-		log.Fatalf("apply schema: %v", err)
+	migrations, err := loadMigrations()
+	if err != nil {
+		db.Close()
+		return DB{}, err
 	}
-	return DB{DB: db}
+	applied, err := migrateUp(db.DB, migrations, 0)
+	if err != nil {
+		db.Close()
+		return DB{}, fmt.Errorf("migrate: %w", err)
+	}
+	for _, m := range applied {
+		log.Printf("applied migration %04d_%s\n", m.Version, m.Name)
+	}
+	return db, nil
 }
 
-func fetchMostRecentSnapshot(db DB) (int64, int64, int64) {
-	var clicksA, clicksB, views int64
-	err := db.QueryRow(`
-		SELECT clicksA, clicksB, views
-		FROM   counter_snapshots
-		ORDER  BY ts DESC
-		LIMIT  1`,
-	).Scan(&clicksA, &clicksB, &views)
-	if err != nil && err != sql.ErrNoRows {
+// openSQLite opens the database without touching its schema.
+func openSQLite(dbPath string) (DB, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
+		return DB{}, fmt.Errorf("mkdir data dir: %w", err)
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_journal_mode=WAL", dbPath))
+	if err != nil {
+		return DB{}, fmt.Errorf("open db: %w", err)
+	}
+	return DB{DB: db}, nil
+}
+
+func fetchMostRecentSnapshot(db Store, contest string) (map[string]int64, int64) {
+	latest, _, err := db.LatestSnapshot(contest)
+	if err != nil {
 		fmt.Println("Fatal error fetching most recent snapshot:", err)
 		panic(err)
 	}
-
-	return clicksA, clicksB, views
+	return latest.Clicks, latest.views
 }
 
-func backupWithVacuumInto(ctx context.Context, db DB, dir string) error {
-	ts := time.Now().UTC().Format("2006-01-02")
-	filename := filepath.Join(dir, fmt.Sprintf("backup-%s.db", ts))
-	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
-		return err
+// fetchLatestSnapshot returns the newest snapshot of a contest, or false when
+// it has none yet.
+func fetchLatestSnapshot(db DB, contest string) (ViewPoint, bool, error) {
+	latest := ViewPoint{Point: Point{Clicks: map[string]int64{}}}
+	err := db.QueryRow(`
+		SELECT ts, views
+		FROM   `+allSnapshots+`
+		WHERE  contest = ?
+		ORDER  BY ts DESC
+		LIMIT  1`, contest,
+	).Scan(&latest.Ts, &latest.views)
+	if err == sql.ErrNoRows {
+		return latest, false, nil
 	}
-
-	// If a backup for today exists, remove it and recreate it.
-	// Todo: filter by quantity or age instead.
-	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
-		return err
+	if err != nil {
+		return latest, false, err
 	}
 
-	// SQL single quotes are escaped via doubling
-	quoted := strings.ReplaceAll(filename, `'`, `''`)
+	latest.Clicks, err = fetchSnapshotClicks(db, contest, latest.Ts)
+	if err != nil {
+		return latest, false, err
+	}
+	return latest, true, nil
+}
 
-	_, err := db.ExecContext(ctx, "VACUUM INTO '"+quoted+"'")
-	return err
+func fetchSnapshotClicks(db DB, contest string, ts int64) (map[string]int64, error) {
+	rows, err := db.Query(`SELECT option, clicks FROM `+allSnapshotClicks+` WHERE contest = ? AND ts = ?`, contest, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clicks := make(map[string]int64)
+	for rows.Next() {
+		var option string
+		var n int64
+		if err := rows.Scan(&option, &n); err != nil {
+			return nil, err
+		}
+		clicks[option] = n
+	}
+	return clicks, rows.Err()
 }
 
 // ---------- Snapshots -------------
@@ -86,33 +126,63 @@ func (app *App) takePeriodicSnapshots() {
 	if !app.configuration.snapshotEnabled() {
 		return
 	}
+	app.workers.Add(1)
 	go func() {
+		defer app.workers.Done()
 		ticker := time.NewTicker(app.configuration.snapshotInterval) // Source from config
 		defer ticker.Stop()
 
-		var previousClickACount, previousClickBCount int64
-		for range ticker.C {
-			currentClicksA := app.clicksA.Load()
-			currentClicksB := app.clicksB.Load()
+		var previousClicks map[string]int64
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			replica := app.clicks.ReplicaState()
+			currentClicks := app.clicks.Snapshot()
 			currentViews := app.views.Load()
-			if currentClicksA == previousClickACount &&
-				currentClicksB == previousClickBCount {
+			if sameCounts(currentClicks, previousClicks) {
 				continue
 			}
-			fmt.Println("inserting: ", currentClicksA, currentClicksB, currentViews)
-			if err := insertSnapshot(app.db, currentClicksA, currentClicksB, currentViews); err != nil {
+			fmt.Println("inserting: ", currentClicks, currentViews)
+			start := time.Now()
+			err := insertSnapshot(app.db, app.slug(), currentClicks, currentViews)
+			telemetry.snapshotLatency.Observe(time.Since(start).Seconds())
+			if err != nil {
+				telemetry.snapshotErrors.Add(1)
 				log.Println("Error taking snapshot:", err)
 				continue
 			}
-			previousClickACount, previousClickBCount = currentClicksA, currentClicksB
+			app.saveReplica(replica)
+			previousClicks = currentClicks
 		}
 	}()
 }
 
-func insertSnapshot(db DB, clicksA, clicksB, views int64) error {
-	_, err := db.ExecContext(context.Background(),
-		`INSERT INTO counter_snapshots(ts, clicksA, clicksB, views) 
-		VALUES (?,?,?,?)`,
-		time.Now().UTC().Unix(), clicksA, clicksB, views)
-	return err
+func insertSnapshot(db Store, contest string, clicks map[string]int64, views int64) error {
+	return db.InsertSnapshot(contest, time.Now().UTC().Unix(), clicks, views)
+}
+
+func insertSnapshotAt(db DB, contest string, ts int64, clicks map[string]int64, views int64) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO counter_snapshots(contest, ts, views) VALUES (?,?,?)`,
+		contest, ts, views); err != nil {
+		return err
+	}
+	for option, n := range clicks {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO snapshot_clicks(contest, ts, option, clicks) VALUES (?,?,?,?)`,
+			contest, ts, option, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// ---------------------- helpers ----------------------
+
+func newTestDB(t *testing.T) DB {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "clicks.db"))
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// ---------------------- snapshots ----------------------
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := insertSnapshotAt(db, "", 100, map[string]int64{"A": 1, "B": 2}, 5); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := insertSnapshotAt(db, "", 200, map[string]int64{"A": 3, "B": 4, "C": 1}, 9); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	clicks, views := fetchMostRecentSnapshot(db, "")
+	if views != 9 || !sameCounts(clicks, map[string]int64{"A": 3, "B": 4, "C": 1}) {
+		t.Fatalf("most recent snapshot: got %v / %d views", clicks, views)
+	}
+
+	pts, err := fetchPoints(db, "")
+	if err != nil {
+		t.Fatalf("fetchPoints: %v", err)
+	}
+	if len(pts) != 2 || pts[0].Ts != 100 || pts[1].Ts != 200 {
+		t.Fatalf("fetchPoints: unexpected points %+v", pts)
+	}
+	if pts[0].Clicks["B"] != 2 || pts[1].Clicks["C"] != 1 || pts[1].views != 9 {
+		t.Fatalf("fetchPoints: unexpected values %+v", pts)
+	}
+}
+
+// ---------------------- migration ----------------------
+
+func TestOpenDBMigratesFixedColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacy, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open legacy: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE counter_snapshots (
+			ts      INTEGER PRIMARY KEY,
+			clicksA INTEGER NOT NULL,
+			clicksB INTEGER NOT NULL,
+			views   INTEGER NOT NULL
+		);
+		INSERT INTO counter_snapshots VALUES (10, 1, 0, 3), (20, 5, 7, 11);`)
+	if err != nil {
+		t.Fatalf("seed legacy: %v", err)
+	}
+	legacy.Close()
+
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	defer db.Close()
+
+	if has, _ := hasColumn(db.DB, "counter_snapshots", "clicksA"); has {
+		t.Fatal("clicksA column should have been dropped")
+	}
+	if has, _ := hasColumn(db.DB, "counter_snapshots", "contest"); !has {
+		t.Fatal("contest column should have been added")
+	}
+
+	clicks, views := fetchMostRecentSnapshot(db, "")
+	if views != 11 || !sameCounts(clicks, map[string]int64{"A": 5, "B": 7}) {
+		t.Fatalf("migrated snapshot: got %v / %d views", clicks, views)
+	}
+
+	pts, err := fetchPoints(db, "")
+	if err != nil || len(pts) != 2 || pts[0].Clicks["A"] != 1 {
+		t.Fatalf("migrated history: %+v, err %v", pts, err)
+	}
+}
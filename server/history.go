@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const maxHistoryStep = 10000
+
+// HistoryQuery selects the snapshots returned by /metrics/history.
+//
+//	from, to  unix seconds, inclusive; zero means unbounded
+//	since     unix seconds, exclusive; for fetching only points newer than the last one seen
+//	step      bucket the range so roughly this many points come back; zero returns every snapshot
+type HistoryQuery struct {
+	From  int64
+	To    int64
+	Since int64
+	Step  int64
+}
+
+func parseHistoryQuery(r *http.Request) (HistoryQuery, error) {
+	var q HistoryQuery
+	params := []struct {
+		name string
+		dst  *int64
+	}{
+		{"from", &q.From},
+		{"to", &q.To},
+		{"since", &q.Since},
+		{"step", &q.Step},
+	}
+	for _, p := range params {
+		raw := r.URL.Query().Get(p.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return HistoryQuery{}, fmt.Errorf("%s must be a non-negative integer", p.name)
+		}
+		*p.dst = n
+	}
+	if q.To != 0 && q.From > q.To {
+		return HistoryQuery{}, fmt.Errorf("from must not be after to")
+	}
+	if q.Step > maxHistoryStep {
+		return HistoryQuery{}, fmt.Errorf("step must be at most %d", maxHistoryStep)
+	}
+	return q, nil
+}
+
+// bounds folds since into from and fills open ends with the max int64 so the
+// query can always use a closed range.
+func (q HistoryQuery) bounds() (int64, int64) {
+	from, to := q.From, q.To
+	if q.Since != 0 && q.Since+1 > from {
+		from = q.Since + 1
+	}
+	if to == 0 {
+		to = math.MaxInt64
+	}
+	return from, to
+}
+
+// fetchHistory returns the snapshots of a contest selected by q, reading
+// across the raw and rollup tiers. When a step is given the range is cut into
+// step buckets and the last snapshot of each is kept; counters only grow so
+// the last value is the right one to show.
+func fetchHistory(db DB, contest string, q HistoryQuery) ([]ViewPoint, error) {
+	from, to := q.bounds()
+	width, err := bucketWidth(db, contest, from, to, q.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT s.ts, s.views, c.option, c.clicks
+		FROM   `+allSnapshots+` s
+		LEFT   JOIN `+allSnapshotClicks+` c ON c.contest = s.contest AND c.ts = s.ts
+		WHERE  s.contest = ?
+		AND    s.ts IN (
+			SELECT MAX(ts)
+			FROM   `+allSnapshots+`
+			WHERE  contest = ? AND ts BETWEEN ? AND ?
+			GROUP  BY ts / ?)
+		ORDER  BY s.ts`, contest, contest, from, to, width)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanPoints(rows)
+}
+
+// bucketWidth is the number of seconds per bucket needed to fit the snapshots
+// between from and to into roughly step points.
+func bucketWidth(db DB, contest string, from, to, step int64) (int64, error) {
+	if step <= 0 {
+		return 1, nil
+	}
+	var first, last sql.NullInt64
+	err := db.QueryRow(`
+		SELECT MIN(ts), MAX(ts)
+		FROM   `+allSnapshots+`
+		WHERE  contest = ? AND ts BETWEEN ? AND ?`, contest, from, to,
+	).Scan(&first, &last)
+	if err != nil {
+		return 0, err
+	}
+	if !first.Valid {
+		return 1, nil
+	}
+	span := last.Int64 - first.Int64 + 1
+	return max(1, (span+step-1)/step), nil
+}
+
+// scanPoints folds rows of (ts, views, option, clicks), ordered by ts, into
+// one point per snapshot.
+func scanPoints(rows *sql.Rows) ([]ViewPoint, error) {
+	pts := []ViewPoint{}
+	for rows.Next() {
+		var ts, views int64
+		var option sql.NullString
+		var clicks sql.NullInt64
+		if err := rows.Scan(&ts, &views, &option, &clicks); err != nil {
+			return nil, err
+		}
+		if len(pts) == 0 || pts[len(pts)-1].Ts != ts {
+			pts = append(pts, ViewPoint{
+				Point: Point{Ts: ts, Clicks: make(map[string]int64)},
+				views: views,
+			})
+		}
+		if option.Valid {
+			pts[len(pts)-1].Clicks[option.String] = clicks.Int64
+		}
+	}
+	return pts, rows.Err()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newHistoryTestApp(t *testing.T) *App {
+	t.Helper()
+	app := newTestApp()
+	app.db = newTestDB(t)
+	// one snapshot every 10 seconds from ts=1000 to ts=1990
+	for ts := int64(1000); ts < 2000; ts += 10 {
+		clicks := map[string]int64{"A": ts - 1000, "B": (ts - 1000) / 2}
+		if err := app.db.InsertSnapshot("", ts, clicks, ts); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	return app
+}
+
+func getHistory(t *testing.T, app *App, query string) ([]Point, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics/history"+query, nil)
+	rr := httptest.NewRecorder()
+	app.metricsHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		return nil, rr.Code
+	}
+	var pts []Point
+	if err := json.Unmarshal(rr.Body.Bytes(), &pts); err != nil {
+		t.Fatalf("history %s: invalid json: %v", query, err)
+	}
+	return pts, rr.Code
+}
+
+func TestMetricsHandlerRangeAndSince(t *testing.T) {
+	app := newHistoryTestApp(t)
+
+	all, _ := getHistory(t, app, "")
+	if len(all) != 100 {
+		t.Fatalf("no params: want 100 points, got %d", len(all))
+	}
+
+	pts, _ := getHistory(t, app, "?from=1500&to=1550")
+	if len(pts) != 6 || pts[0].Ts != 1500 || pts[5].Ts != 1550 {
+		t.Fatalf("from/to: unexpected points %+v", pts)
+	}
+	if pts[0].Clicks["A"] != 500 || pts[0].Clicks["B"] != 250 {
+		t.Fatalf("from/to: unexpected clicks %+v", pts[0])
+	}
+
+	pts, _ = getHistory(t, app, "?since=1970")
+	if len(pts) != 2 || pts[0].Ts != 1980 {
+		t.Fatalf("since: unexpected points %+v", pts)
+	}
+
+	pts, _ = getHistory(t, app, "?since=5000")
+	if pts == nil || len(pts) != 0 {
+		t.Fatalf("since after last point: want empty array, got %+v", pts)
+	}
+}
+
+func TestMetricsHandlerStepBucketsKeepLastPoint(t *testing.T) {
+	app := newHistoryTestApp(t)
+
+	pts, _ := getHistory(t, app, "?step=10")
+	if len(pts) < 9 || len(pts) > 11 {
+		t.Fatalf("step=10: want roughly 10 points, got %d", len(pts))
+	}
+	last := pts[len(pts)-1]
+	if last.Ts != 1990 || last.Clicks["A"] != 990 {
+		t.Fatalf("step=10: last bucket should keep the newest snapshot, got %+v", last)
+	}
+	for i := 1; i < len(pts); i++ {
+		if pts[i].Ts <= pts[i-1].Ts {
+			t.Fatalf("step=10: points out of order %+v", pts)
+		}
+	}
+}
+
+func TestMetricsHandlerRejectsBadParams(t *testing.T) {
+	app := newHistoryTestApp(t)
+	for _, query := range []string{"?from=abc", "?step=-1", "?from=20&to=10", "?step=1000000"} {
+		if _, code := getHistory(t, app, query); code != http.StatusBadRequest {
+			t.Errorf("%s: want HTTP 400, got %d", query, code)
+		}
+	}
+
+	app.db.Close()
+	if _, code := getHistory(t, app, ""); code != http.StatusInternalServerError {
+		t.Errorf("closed db: want HTTP 500, got %d", code)
+	}
+}
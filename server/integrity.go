@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var errNoHealthyBackup = errors.New("no backup passed the integrity check")
+
+// RecoveryReport describes how a corrupt database was replaced.
+type RecoveryReport struct {
+	Quarantined   string // where the corrupt file was moved
+	Restored      string // the backup that replaced it
+	BackupLatest  int64  // unix seconds of the newest snapshot in the backup
+	LostSnapshots int64  // snapshots in the corrupt file newer than the backup, -1 if unreadable
+}
+
+// checkFileIntegrity runs PRAGMA integrity_check against the database at
+// path. Files that SQLite can't even read count as failures.
+func checkFileIntegrity(path string) error {
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return checkIntegrity(db)
+}
+
+func checkIntegrity(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ensureHealthyDB checks the database at dbPath before it is opened for
+// serving. A corrupt file is swapped for the newest healthy backup; when no
+// backup is healthy the corrupt file is left untouched and an error returned
+// so the server does not quietly start from zero.
+func ensureHealthyDB(dbPath, backupDir string, now time.Time) error {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	}
+	err := checkFileIntegrity(dbPath)
+	if err == nil {
+		return nil
+	}
+	log.Println("Database", dbPath, "is corrupt:", err)
+
+	report, err := recoverDB(dbPath, backupDir, now)
+	if err != nil {
+		return err
+	}
+	log.Println("Quarantined corrupt database as", report.Quarantined)
+	log.Printf("Restored %s, newest snapshot from %s",
+		report.Restored, time.Unix(report.BackupLatest, 0).UTC().Format(time.RFC3339))
+	if report.LostSnapshots < 0 {
+		log.Println("Could not read the corrupt database, the number of lost snapshots is unknown")
+	} else {
+		log.Println("Snapshots lost since that backup:", report.LostSnapshots)
+	}
+	return nil
+}
+
+// recoverDB moves the corrupt database aside and copies the newest backup that
+// passes the integrity check into its place.
+func recoverDB(dbPath, backupDir string, now time.Time) (RecoveryReport, error) {
+	backups, err := listBackups(backupDir)
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+	var healthy *backupFile
+	var latest int64
+	for i := range backups {
+		if err := checkFileIntegrity(backups[i].path); err != nil {
+			log.Println("Skipping backup", backups[i].path+":", err)
+			continue
+		}
+		if latest, err = latestSnapshotIn(backups[i].path); err != nil {
+			log.Println("Skipping backup", backups[i].path+":", err)
+			continue
+		}
+		healthy = &backups[i]
+		break
+	}
+	if healthy == nil {
+		return RecoveryReport{}, errNoHealthyBackup
+	}
+
+	report := RecoveryReport{
+		Quarantined:   fmt.Sprintf("%s.corrupt-%s", dbPath, now.UTC().Format(backupLayout)),
+		Restored:      healthy.path,
+		BackupLatest:  latest,
+		LostSnapshots: -1,
+	}
+	if lost, err := countSnapshotsAfter(dbPath, report.BackupLatest); err == nil {
+		report.LostSnapshots = lost
+	}
+
+	// The WAL and shared memory files belong to the corrupt database and
+	// would be replayed over the restored copy if left in place.
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(dbPath+suffix, report.Quarantined+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return RecoveryReport{}, err
+		}
+	}
+	if err := copyFile(healthy.path, dbPath); err != nil {
+		return RecoveryReport{}, fmt.Errorf("restore %s: %w", healthy.path, err)
+	}
+	return report, nil
+}
+
+func latestSnapshotIn(path string) (int64, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	snapshots, err := snapshotsIn(db)
+	if err != nil {
+		return 0, err
+	}
+	var ts sql.NullInt64
+	err = db.QueryRow(`SELECT MAX(ts) FROM ` + snapshots).Scan(&ts)
+	return ts.Int64, err
+}
+
+// countSnapshotsAfter is best effort: the file is corrupt, so any part of it
+// may be unreadable.
+func countSnapshotsAfter(path string, ts int64) (int64, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	snapshots, err := snapshotsIn(db)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = db.QueryRow(`SELECT COUNT(*) FROM `+snapshots+` WHERE ts > ?`, ts).Scan(&n)
+	return n, err
+}
+
+// snapshotsIn picks the snapshot tables of a database file of any age.
+// Backups taken before the rollups migration, and legacy daily backups, only
+// have counter_snapshots.
+func snapshotsIn(db *sql.DB) (string, error) {
+	rollups, err := hasColumn(db, "rollup_snapshots", "ts")
+	if err != nil {
+		return "", err
+	}
+	if !rollups {
+		return "counter_snapshots", nil
+	}
+	return allSnapshots, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
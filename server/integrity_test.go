@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// corruptFile overwrites the middle of a database so its header still looks
+// valid but its pages don't.
+func corruptFile(t *testing.T, path string) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 4096; i < len(raw); i++ {
+		raw[i] = 0xAB
+	}
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func seededDB(t *testing.T, path string, snapshots ...int64) {
+	t.Helper()
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range snapshots {
+		if err := insertSnapshotAt(db, "", ts, map[string]int64{"A": ts}, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+}
+
+func TestCheckFileIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	healthy := filepath.Join(dir, "healthy.db")
+	seededDB(t, healthy, 100)
+	if err := checkFileIntegrity(healthy); err != nil {
+		t.Fatalf("healthy db: %v", err)
+	}
+
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, []byte(strings.Repeat("not a database ", 1000)), 0o644)
+	if err := checkFileIntegrity(garbage); err == nil {
+		t.Fatal("garbage file should fail the check")
+	}
+}
+
+func TestEnsureHealthyDBRestoresNewestHealthyBackup(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	dbPath := filepath.Join(dir, "clicks.db")
+
+	seededDB(t, dbPath, 100, 200)
+	db, err := openDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupWithVacuumInto(context.Background(), db, backupDir, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	insertSnapshotAt(db, "", 300, map[string]int64{"A": 300}, 300)
+	newest, _ := backupWithVacuumInto(context.Background(), db, backupDir, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC))
+	for ts := int64(400); ts < 2000; ts++ {
+		insertSnapshotAt(db, "", ts, map[string]int64{"A": ts}, ts)
+	}
+	db.Close()
+
+	corruptFile(t, newest)
+	corruptFile(t, dbPath)
+
+	now := time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)
+	if err := ensureHealthyDB(dbPath, backupDir, now); err != nil {
+		t.Fatalf("ensureHealthyDB: %v", err)
+	}
+	if err := checkFileIntegrity(dbPath); err != nil {
+		t.Fatalf("restored db should be healthy: %v", err)
+	}
+	if _, err := os.Stat(dbPath + ".corrupt-2025-01-03T000000Z"); err != nil {
+		t.Fatalf("corrupt db should be quarantined: %v", err)
+	}
+
+	restored, err := openDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	clicks, _ := fetchMostRecentSnapshot(restored, "")
+	if clicks["A"] != 200 {
+		t.Fatalf("want the older, healthy backup (A=200), got %v", clicks)
+	}
+}
+
+func TestEnsureHealthyDBWithoutBackupLeavesFileAlone(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "clicks.db")
+	os.WriteFile(dbPath, []byte(strings.Repeat("not a database ", 1000)), 0o644)
+
+	err := ensureHealthyDB(dbPath, filepath.Join(dir, "backups"), time.Now())
+	if err != errNoHealthyBackup {
+		t.Fatalf("want errNoHealthyBackup, got %v", err)
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Fatalf("corrupt db must stay in place: %v", err)
+	}
+}
+
+func TestEnsureHealthyDBIgnoresMissingAndHealthyFiles(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "clicks.db")
+	if err := ensureHealthyDB(dbPath, dir, time.Now()); err != nil {
+		t.Fatalf("missing db: %v", err)
+	}
+	seededDB(t, dbPath, 100)
+	if err := ensureHealthyDB(dbPath, dir, time.Now()); err != nil {
+		t.Fatalf("healthy db: %v", err)
+	}
+}
+
+func TestRecoverDBCountsLostSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	dbPath := filepath.Join(dir, "clicks.db")
+
+	seededDB(t, dbPath, 100)
+	db, _ := openDB(dbPath)
+	backupWithVacuumInto(context.Background(), db, backupDir, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	insertSnapshotAt(db, "", 200, map[string]int64{"A": 2}, 2)
+	insertSnapshotAt(db, "", 300, map[string]int64{"A": 3}, 3)
+	db.Close()
+
+	report, err := recoverDB(dbPath, backupDir, time.Now())
+	if err != nil {
+		t.Fatalf("recoverDB: %v", err)
+	}
+	if report.BackupLatest != 100 || report.LostSnapshots != 2 {
+		t.Fatalf("report: got %+v", report)
+	}
+}
+
+func TestEnsureHealthyDBRestoresLegacyBackup(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	dbPath := filepath.Join(dir, "clicks.db")
+	os.MkdirAll(backupDir, 0o755)
+
+	// A daily backup from before migrations existed, and a newer file that
+	// passes the integrity check but has no snapshots table at all.
+	legacy, err := sql.Open("sqlite", filepath.Join(backupDir, "backup-2025-01-01.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE counter_snapshots (ts INTEGER PRIMARY KEY, views INTEGER, clicksA INTEGER, clicksB INTEGER)`,
+		`INSERT INTO counter_snapshots VALUES (100, 10, 7, 3)`,
+	} {
+		if _, err := legacy.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy.Close()
+	empty, _ := sql.Open("sqlite", filepath.Join(backupDir, "backup-2025-01-02T000000Z.db"))
+	empty.Exec(`CREATE TABLE unrelated (x INTEGER)`)
+	empty.Close()
+
+	seededDB(t, dbPath, 100, 200)
+	corruptFile(t, dbPath)
+
+	report, err := recoverDB(dbPath, backupDir, time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("recoverDB: %v", err)
+	}
+	if !strings.HasSuffix(report.Restored, "backup-2025-01-01.db") || report.BackupLatest != 100 {
+		t.Fatalf("report: got %+v", report)
+	}
+
+	restored, err := openDB(dbPath)
+	if err != nil {
+		t.Fatalf("legacy backup should migrate on open: %v", err)
+	}
+	defer restored.Close()
+	clicks, _ := fetchMostRecentSnapshot(restored, "")
+	if clicks["A"] != 7 || clicks["B"] != 3 {
+		t.Fatalf("want the legacy counts, got %v", clicks)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// The internal server carries everything that should not be reachable from
+// the internet: pprof, expvar, a readiness check for the load balancer and,
+// when ADMIN_TOKEN is set, the admin console. It listens on INTERNAL_ADDR,
+// which has to be a loopback address unless INTERNAL_ADDR_PUBLIC is set.
+
+func (app *App) internalMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Debugging
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	// Health
+	mux.HandleFunc("/readyz", app.readyHandler)
+
+	// Admin, with the styles and scripts its page loads
+	if app.configuration.adminToken != "" {
+		mux.Handle("/assets/", site.assetHandler())
+		app.registerAdminRoutes(mux)
+	}
+	return mux
+}
+
+// readyHandler tells load balancers whether to send traffic here. The server
+// stops being ready as soon as it starts draining, or when the database can't
+// be read.
+func (app *App) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if app.isDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if _, _, err := app.db.LatestSnapshot(app.slug()); err != nil {
+		log.Println("Readiness check failed:", err)
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// launchInternal starts the internal server, or returns nil when
+// INTERNAL_ADDR is not set.
+func launchInternal(config *Configuration, app *App) *http.Server {
+	if config.internalAddr == "" {
+		return nil
+	}
+	server := &http.Server{Addr: config.internalAddr, Handler: app.internalMux()}
+	log.Println("internal server listening on", config.internalAddr)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("internal server failed: %v", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveMux(mux *http.ServeMux, path string) int {
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+	return rr.Code
+}
+
+func TestDebugRoutesOnlyOnInternalMux(t *testing.T) {
+	app := newTestApp()
+	app.configuration.adminToken = "let-me-in"
+	public := app.publicMux(NewContests(app.db, app.configuration, &Services{}))
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/readyz"} {
+		if code := serveMux(public, path); code != http.StatusNotFound {
+			t.Errorf("public %s: want 404, got %d", path, code)
+		}
+		if code := serveMux(app.internalMux(), path); code != http.StatusOK {
+			t.Errorf("internal %s: want 200, got %d", path, code)
+		}
+	}
+	for _, path := range []string{"/admin", "/admin/login"} {
+		if code := serveMux(public, path); code != http.StatusNotFound {
+			t.Errorf("public %s: want 404, got %d", path, code)
+		}
+	}
+	if code := serveMux(app.internalMux(), "/admin"); code != http.StatusOK {
+		t.Fatalf("internal /admin: got %d", code)
+	}
+	if code := serveMux(app.internalMux(), site.assetURL("style.css")); code != http.StatusOK {
+		t.Fatalf("the admin page's styles should be served next to it, got %d", code)
+	}
+}
+
+func TestReadyzReportsDraining(t *testing.T) {
+	app := newTestApp()
+	app.draining = make(chan struct{})
+	mux := app.internalMux()
+	if code := serveMux(mux, "/readyz"); code != http.StatusOK {
+		t.Fatalf("before draining: want 200, got %d", code)
+	}
+	app.drain()
+	if code := serveMux(mux, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("while draining: want 503, got %d", code)
+	}
+}
+
+func TestInternalAddrFromEnv(t *testing.T) {
+	t.Setenv("PPROF_ENABLED", "true")
+	t.Setenv("PPROF_PORT", "6060")
+	if got := internalAddrFromEnv(); got != "127.0.0.1:6060" {
+		t.Fatalf("legacy pprof settings: got %q", got)
+	}
+	t.Setenv("INTERNAL_ADDR", "10.0.0.5:9000")
+	if got := internalAddrFromEnv(); got != "10.0.0.5:9000" {
+		t.Fatalf("INTERNAL_ADDR should win, got %q", got)
+	}
+}
+
+func TestValidateInternalAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:6060": true,
+		"localhost:6060": true,
+		"[::1]:6060":     true,
+		":6060":          false,
+		"0.0.0.0:6060":   false,
+		"10.0.0.5:6060":  false,
+	} {
+		config := &Configuration{internalAddr: addr}
+		if err := config.validate(); (err == nil) != ok {
+			t.Errorf("%s: want ok %v, got %v", addr, ok, err)
+		}
+		config.internalPublic = true
+		if err := config.validate(); err != nil {
+			t.Errorf("%s with INTERNAL_ADDR_PUBLIC: %v", addr, err)
+		}
+	}
+
+	config := &Configuration{adminToken: "let-me-in"}
+	if err := config.validate(); err == nil {
+		t.Fatal("ADMIN_TOKEN without INTERNAL_ADDR should be refused")
+	}
+}
@@ -1,94 +1,240 @@
 package main
 
 import (
-	"context"
 	"log"
-	"net/http" //_ "net/http/pprof"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
-	"text/template"
+	"syscall"
+	"time"
 )
 
 const (
-	dbFilePath      = "data/clicks.db"
-	schemaFilePath  = "sql/schema.sql"
-	backupDirectory = "data/backups"
-)
-
-var (
-	greeting = "Choose your favorite!"
-	tmpl     = template.Must(template.ParseGlob("templates/*.tmpl.html")) // embed?
+	dbFilePath        = "data/clicks.db"
+	contestConfigPath = "contest.json"
+	backupDirectory   = "data/backups"
 )
 
 type App struct {
-	db            DB
+	db            Store
 	configuration *Configuration
-	broadcaster   *Broadcaster
+	broadcaster   *Broadcaster[Point]
+	counterStream *Broadcaster[CounterEvent] // pre-encoded counter events for /stream and /ws
 	views         atomic.Int64
-	clicksA       atomic.Int64
-	clicksB       atomic.Int64
+	clicks        *Counters
+	*Services
+	contest        *Contest // nil for the main contest
+	lastActive     atomic.Int64
+	streamClients  atomic.Int64
+	feedClients    atomic.Int64
+	socketClients  atomic.Int64
+	peersReachable atomic.Int64
+	announcement   atomic.Pointer[string] // replaces the greeting, see admin.go
+	done           chan struct{}
+	workers        sync.WaitGroup // background jobs, stopped by done
+}
+
+// Services are shared by the main contest and every user contest.
+type Services struct {
+	clickLog        *ClickLog
+	limiter         *RateLimiter
+	milestoneTokens *MilestoneTokens
+	backupSink      BackupSink    // nil keeps backups in data/backups only
+	draining        chan struct{} // closed when shutdown begins
+	paused          atomic.Bool   // clicks are refused while an admin has paused them
 }
 
 func main() {
+	// Commands run before configuration is loaded, so they work without a
+	// .env file.
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	config := getConfiguration()
-	db := initDB()
+	if err := config.validate(); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	db := initDB(config)
 
-	app := createApp(db, config)
-	app.takePeriodicSnapshots()
-	app.sendPeriodicBroadcasts()
+	backupSink, err := newBackupSink(config.backups.sink)
+	if err != nil {
+		log.Fatal("Invalid backup sink: ", err)
+	}
 
-	launchPprof(config) // Need seperate mux to ensure pprof is truly disabled
+	services := &Services{
+		clickLog:        startClickLog(db, config.clickLog),
+		limiter:         NewRateLimiter(config.clickRate, config.clickBurst),
+		milestoneTokens: NewMilestoneTokens(config.milestones.secret, config.milestones.ttl),
+		backupSink:      backupSink,
+		draining:        make(chan struct{}),
+	}
+	services.limiter.evictPeriodically()
 
-	// Site
-	http.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("assets"))))
-	http.HandleFunc("/{$}", app.homeHandler)
+	app := createApp(db, config, services)
+	app.markDBInUse()
+	app.takePeriodicSnapshots()
+	app.sendPeriodicBroadcasts()
+	app.publishCounterChanges()
+	app.syncPeersPeriodically()
+	app.compactPeriodically()
+	app.backupPeriodically()
 
-	// Clicks
-	http.HandleFunc("/click/", app.clickHandler)
+	if config.siteDir != "" {
+		useSiteDir(config.siteDir)
+	}
 
-	// Updates
-	http.HandleFunc("/stream", app.streamHandler)
-	http.HandleFunc("/metrics/feed", app.metricsFeed)
-	http.HandleFunc("/metrics/history", app.metricsHandler)
+	contests := loadContests(db, config, services)
+	contests.expireIdleContests()
+	metrics := launchMetrics(config, app, contests)
+	internal := launchInternal(config, app)
 
-	// Modals
-	http.HandleFunc("/about", app.aboutHandler)
-	http.HandleFunc("/chart", app.chartHandler)
-	http.HandleFunc("/modal/toggle", app.modalToggle)
+	server := &http.Server{Addr: ":" + config.port, Handler: app.publicMux(contests)}
+	go func() {
+		log.Println("listening on :" + config.port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	// Unused server side graph
-	http.HandleFunc("/metrics.svg", db.metricsAsSvg)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	shutdown(server, internal, metrics, app, contests, config.shutdownTimeout)
+}
 
-	log.Println("listening on :" + config.port)
-	log.Fatal(http.ListenAndServe(":"+config.port, nil))
+func createApp(db Store, config *Configuration, services *Services) *App {
+	app := newApp(db, config, services, nil)
+	if app.views.Load() != 0 {
+		db.Backup(config.backupDir(), config.backups, services.backupSink)
+	}
+	return app
 }
 
-func createApp(db DB, config *Configuration) *App {
+// newApp builds the counters for one contest and restores them from its most
+// recent snapshot plus any clicks logged after it. The main contest passes a
+// nil contest.
+func newApp(db Store, config *Configuration, services *Services, contest *Contest) *App {
 	app := App{
 		db:            db,
 		configuration: config,
-		broadcaster:   NewBroadcaster(),
+		broadcaster:   NewReplayBroadcaster(config.feedPolicy, config.feedReplay, pointID),
+		counterStream: NewBroadcaster[CounterEvent](config.streamPolicy),
 		views:         atomic.Int64{},
-		clicksA:       atomic.Int64{},
-		clicksB:       atomic.Int64{},
+		clicks:        NewCounters(optionIDs(config.contest.Options)),
+		Services:      services,
+		contest:       contest,
+		done:          make(chan struct{}),
 	}
-	clickCountA, clickCountB, viewCount := fetchMostRecentSnapshot(db)
-	app.clicksA.Store(clickCountA)
-	app.clicksB.Store(clickCountB)
+	clickCounts, viewCount := fetchMostRecentSnapshot(db, app.slug())
+	app.clicks.StoreAll(clickCounts)
 	app.views.Store(viewCount)
-	if viewCount != 0 {
-		backupWithVacuumInto(context.Background(), db, backupDirectory)
+	if contest == nil && config.peers.enabled() {
+		app.replicate(config.peers.node, clickCounts)
+	}
+	if services.clickLog != nil {
+		app.replayClickLog()
 	}
+	app.touch()
 	return &app
 }
 
-func launchPprof(config *Configuration) {
-	if !config.pprofEnabled {
+// publicMux holds every route served on PORT. Debugging and the admin console
+// are kept off it, see internal.go.
+func (app *App) publicMux(contests *Contests) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Site
+	mux.Handle("/assets/", site.assetHandler())
+	app.registerContestRoutes(mux)
+
+	// User contests
+	mux.HandleFunc("/contests", contests.createHandler)
+	mux.HandleFunc("/c/{slug}/", contests.contestHandler)
+
+	// Replication
+	if app.configuration.peers.enabled() {
+		mux.HandleFunc("/peers/sync", app.peerSyncHandler)
+	}
+
+	// Unused server side graph
+	mux.HandleFunc("/metrics.svg", app.metricsAsSvg)
+	return mux
+}
+
+// registerContestRoutes adds the pages and feeds of a single contest. The main
+// contest is served from / and user contests from /c/{slug}/, so front-end
+// urls are relative.
+func (app *App) registerContestRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/{$}", app.homeHandler)
+
+	// Clicks
+	mux.HandleFunc("/click/", app.clickHandler)
+
+	// Updates
+	mux.HandleFunc("/stream", app.streamHandler)
+	mux.HandleFunc("/metrics/feed", app.metricsFeed)
+	mux.HandleFunc("/metrics/history", app.metricsHandler)
+	if app.configuration.websocketEnabled {
+		mux.Handle("/ws", app.socketHandler()) // clicks and updates on one connection
+	}
+
+	// Modals
+	mux.HandleFunc("/about", app.aboutHandler)
+	mux.HandleFunc("/chart", app.chartHandler)
+	mux.HandleFunc("/milestones", app.milestonesHandler)
+	mux.HandleFunc("/modal/toggle", app.modalToggle)
+
+	// Milestones
+	mux.HandleFunc("/milestones/claim", app.claimMilestoneHandler)
+}
+
+// replayClickLog adds clicks that were logged but never made it into a
+// snapshot, e.g. because the server crashed.
+func (app *App) replayClickLog() {
+	missed, err := app.db.ClicksSinceSnapshot(app.slug())
+	if err != nil {
+		log.Println("Error replaying click log:", err)
 		return
 	}
-	log.Println("pprof enabled, listening on port", config.pprofPort)
-	go func() {
-		if err := http.ListenAndServe(":"+config.pprofPort, nil); err != nil {
-			log.Fatalf("pprof server failed: %v", err)
+	for option, n := range missed {
+		if _, ok := app.clicks.Add(option, n); ok && n > 0 {
+			log.Printf("recovered %d clicks for %s/%s from click log\n", n, app.slug(), option)
 		}
-	}()
+	}
+}
+
+func (app *App) slug() string {
+	if app.contest == nil {
+		return ""
+	}
+	return app.contest.Slug
+}
+
+// message is the greeting, unless an admin announced something else.
+func (app *App) message() string {
+	if announced := app.announcement.Load(); announced != nil {
+		return *announced
+	}
+	return app.configuration.contest.Greeting
+}
+
+func (app *App) touch() {
+	app.lastActive.Store(time.Now().Unix())
+}
+
+// close stops the background jobs of the app and waits for them to finish.
+func (app *App) close() {
+	close(app.done)
+	app.workers.Wait()
+}
+
+func optionIDs(options []Option) []string {
+	ids := make([]string, len(options))
+	for i, o := range options {
+		ids[i] = o.ID
+	}
+	return ids
 }
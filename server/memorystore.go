@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that lives and dies with the process. It answers
+// the same queries as the SQLite store, so tests can run handlers against it
+// without a database file.
+type MemoryStore struct {
+	mu         sync.Mutex
+	snapshots  map[string][]ViewPoint // per contest, ordered by ts
+	events     []ClickEvent
+	contests   map[string]storedContest
+	milestones map[milestoneKey]RecordedMilestone
+	replicas   map[string]ReplicaState // per contest
+	audit      []AuditEntry
+}
+
+type milestoneKey struct {
+	contest, option, kind string
+	count                 int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		snapshots:  make(map[string][]ViewPoint),
+		contests:   make(map[string]storedContest),
+		milestones: make(map[milestoneKey]RecordedMilestone),
+		replicas:   make(map[string]ReplicaState),
+	}
+}
+
+// ---------- Snapshots -------------
+
+func (s *MemoryStore) LatestSnapshot(contest string) (ViewPoint, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pts := s.snapshots[contest]
+	if len(pts) == 0 {
+		return ViewPoint{Point: Point{Clicks: map[string]int64{}}}, false, nil
+	}
+	return copyViewPoint(pts[len(pts)-1]), true, nil
+}
+
+func (s *MemoryStore) InsertSnapshot(contest string, ts int64, clicks map[string]int64, views int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pts := s.snapshots[contest]
+	i := sort.Search(len(pts), func(i int) bool { return pts[i].Ts >= ts })
+	if i < len(pts) && pts[i].Ts == ts {
+		return fmt.Errorf("snapshot of contest %q at %d already exists", contest, ts)
+	}
+	point := ViewPoint{Point: Point{Ts: ts, Clicks: maps.Clone(clicks)}, views: views}
+	if point.Clicks == nil {
+		point.Clicks = make(map[string]int64)
+	}
+	s.snapshots[contest] = append(pts[:i], append([]ViewPoint{point}, pts[i:]...)...)
+	return nil
+}
+
+// History keeps the last snapshot of each bucket, like fetchHistory.
+func (s *MemoryStore) History(contest string, q HistoryQuery) ([]ViewPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, to := q.bounds()
+	var inRange []ViewPoint
+	for _, p := range s.snapshots[contest] {
+		if p.Ts >= from && p.Ts <= to {
+			inRange = append(inRange, p)
+		}
+	}
+
+	width := int64(1)
+	if q.Step > 0 && len(inRange) > 0 {
+		span := inRange[len(inRange)-1].Ts - inRange[0].Ts + 1
+		width = max(1, (span+q.Step-1)/q.Step)
+	}
+	pts := []ViewPoint{}
+	for i, p := range inRange {
+		if i+1 < len(inRange) && inRange[i+1].Ts/width == p.Ts/width {
+			continue
+		}
+		pts = append(pts, copyViewPoint(p))
+	}
+	return pts, nil
+}
+
+// Compact is a no-op: the memory store keeps every snapshot at full
+// resolution.
+func (s *MemoryStore) Compact(config CompactionConfig, now time.Time) (int64, error) {
+	return 0, nil
+}
+
+func copyViewPoint(p ViewPoint) ViewPoint {
+	p.Clicks = maps.Clone(p.Clicks)
+	return p
+}
+
+// ---------- Click log -------------
+
+func (s *MemoryStore) InsertClickEvents(events []ClickEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *MemoryStore) ClicksSinceSnapshot(contest string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := int64(-1)
+	if pts := s.snapshots[contest]; len(pts) > 0 {
+		latest = pts[len(pts)-1].Ts
+	}
+	clicks := make(map[string]int64)
+	for _, e := range s.events {
+		if e.Contest == contest && e.Ts >= (latest+1)*1000 {
+			clicks[e.Option]++
+		}
+	}
+	return clicks, nil
+}
+
+// ---------- Contests -------------
+
+func (s *MemoryStore) InsertContest(contest *Contest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.contests[contest.Slug]; ok {
+		return fmt.Errorf("contest %q already exists", contest.Slug)
+	}
+	c := *contest
+	s.contests[c.Slug] = storedContest{contest: &c, lastActive: c.CreatedAt}
+	return nil
+}
+
+func (s *MemoryStore) Contests() ([]storedContest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []storedContest
+	for _, stored := range s.contests {
+		c := *stored.contest
+		out = append(out, storedContest{contest: &c, lastActive: stored.lastActive})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].contest.Slug < out[j].contest.Slug })
+	return out, nil
+}
+
+func (s *MemoryStore) CountContestsBy(creator string, since int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, stored := range s.contests {
+		if stored.contest.Creator == creator && stored.contest.CreatedAt >= since {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) UpdateContestActivity(slug string, lastActive int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.contests[slug]; ok {
+		stored.lastActive = lastActive
+		s.contests[slug] = stored
+	}
+	return nil
+}
+
+// DeleteContest removes a contest with all of its snapshots and clicks.
+func (s *MemoryStore) DeleteContest(slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.contests, slug)
+	delete(s.snapshots, slug)
+	kept := s.events[:0]
+	for _, e := range s.events {
+		if e.Contest != slug {
+			kept = append(kept, e)
+		}
+	}
+	s.events = kept
+	for key := range s.milestones {
+		if key.contest == slug {
+			delete(s.milestones, key)
+		}
+	}
+	return nil
+}
+
+// ---------- Milestones -------------
+
+func (s *MemoryStore) InsertMilestone(m Milestone, name, client string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := milestoneKey{contest: m.Contest, option: m.Option, kind: m.Kind, count: m.Count}
+	if _, ok := s.milestones[key]; ok {
+		return errMilestoneTaken
+	}
+	s.milestones[key] = RecordedMilestone{Milestone: m, Name: name, Ts: time.Now().UTC().Unix()}
+	return nil
+}
+
+func (s *MemoryStore) Milestones(contest string, limit int) ([]RecordedMilestone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []RecordedMilestone
+	for key, m := range s.milestones {
+		if key.contest == contest {
+			out = append(out, m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Ts != out[j].Ts {
+			return out[i].Ts > out[j].Ts
+		}
+		return out[i].Count > out[j].Count
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// ---------- Replication -------------
+
+func (s *MemoryStore) ReplicaCounts(contest string) (ReplicaState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := make(ReplicaState)
+	for node, options := range s.replicas[contest] {
+		state[node] = maps.Clone(options)
+	}
+	return state, nil
+}
+
+func (s *MemoryStore) SaveReplicaCounts(contest string, state ReplicaState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.replicas[contest]
+	if !ok {
+		stored = make(ReplicaState)
+		s.replicas[contest] = stored
+	}
+	for node, options := range state {
+		if stored[node] == nil {
+			stored[node] = make(map[string]int64)
+		}
+		for option, n := range options {
+			stored[node][option] = max(stored[node][option], n)
+		}
+	}
+	return nil
+}
+
+// ---------- Admin audit -------------
+
+func (s *MemoryStore) InsertAudit(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+// AuditLog returns the newest entries first.
+func (s *MemoryStore) AuditLog(limit int) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]AuditEntry, 0, min(limit, len(s.audit)))
+	for i := len(s.audit) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, s.audit[i])
+	}
+	return out, nil
+}
+
+// ---------- Backups -------------
+
+// Backup does nothing; there is no file to copy and the data goes away with
+// the process anyway.
+func (s *MemoryStore) Backup(dir string, config BackupConfig, sink BackupSink) error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in sql/migrations as NNNN_name.up.sql and
+// NNNN_name.down.sql and are embedded in the binary. Each one is applied in
+// its own transaction together with its row in schema_migrations, so a
+// failed migration leaves the database at the previous version.
+//
+//go:embed sql/migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrationHooks run Go code inside a migration's transaction, after its up
+// script, for changes SQL alone can't express.
+var migrationHooks = map[int]func(tx *sql.Tx, m Migration) error{
+	1: upgradeLegacySnapshots,
+}
+
+type MigrationState struct {
+	Migration
+	AppliedAt int64 // unix seconds, 0 when pending
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "sql/migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		prefix, label, ok2 := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || !ok2 || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("bad migration file name %q", name)
+		}
+		raw, err := fs.ReadFile(migrationFiles, path.Join("sql/migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if m.Name != label {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(raw)
+		} else {
+			m.Down = string(raw)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+func appliedMigrations(db *sql.DB) (map[int]int64, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT    NOT NULL,
+			applied_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+func migrationStatus(db *sql.DB, migrations []Migration) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKnownVersions(applied, migrations); err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Migration: m, AppliedAt: applied[m.Version]}
+	}
+	return states, nil
+}
+
+// checkKnownVersions refuses databases migrated by a newer build, whose
+// schema this binary doesn't understand.
+func checkKnownVersions(applied map[int]int64, migrations []Migration) error {
+	for version := range applied {
+		if version > len(migrations) {
+			return fmt.Errorf("database is at schema version %d, this build only knows %d", version, len(migrations))
+		}
+	}
+	return nil
+}
+
+// migrateUp applies pending migrations in order, up to and including target;
+// a target of 0 applies all of them.
+func migrateUp(db *sql.DB, migrations []Migration, target int) ([]Migration, error) {
+	states, err := migrationStatus(db, migrations)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, state := range states {
+		if target > 0 && state.Version > target {
+			break
+		}
+		if state.AppliedAt != 0 {
+			continue
+		}
+		if err := applyMigration(db, state.Migration); err != nil {
+			return done, fmt.Errorf("%04d_%s: %w", state.Version, state.Name, err)
+		}
+		done = append(done, state.Migration)
+	}
+	return done, nil
+}
+
+func applyMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.Up); err != nil {
+		return err
+	}
+	if hook, ok := migrationHooks[m.Version]; ok {
+		if err := hook(tx, m); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations(version, name, applied_at) VALUES (?,?,?)`,
+		m.Version, m.Name, time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDown rolls back the latest steps applied migrations, newest first.
+func migrateDown(db *sql.DB, migrations []Migration, steps int) ([]Migration, error) {
+	states, err := migrationStatus(db, migrations)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(states) - 1; i >= 0 && len(done) < steps; i-- {
+		m := states[i]
+		if m.AppliedAt == 0 {
+			continue
+		}
+		if m.Down == "" {
+			return done, fmt.Errorf("%04d_%s can't be rolled back", m.Version, m.Name)
+		}
+		if err := revertMigration(db, m.Migration); err != nil {
+			return done, fmt.Errorf("%04d_%s: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m.Migration)
+	}
+	return done, nil
+}
+
+func revertMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.Down); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ---------- Legacy -------------
+
+// upgradeLegacySnapshots brings databases created before migrations existed
+// up to the shape of 0001_snapshots. Fresh databases have nothing to do.
+func upgradeLegacySnapshots(tx *sql.Tx, m Migration) error {
+	if err := migrateFixedColumns(tx); err != nil {
+		return fmt.Errorf("migrate snapshots: %w", err)
+	}
+	if err := migrateContestColumn(tx, m.Up); err != nil {
+		return fmt.Errorf("migrate contests: %w", err)
+	}
+	return nil
+}
+
+// migrateFixedColumns moves the clicksA / clicksB columns of databases created
+// before options were configurable into snapshot_clicks, keeping the history
+// under option ids "A" and "B".
+func migrateFixedColumns(tx *sql.Tx) error {
+	legacy, err := hasColumn(tx, "counter_snapshots", "clicksA")
+	if err != nil || !legacy {
+		return err
+	}
+	log.Println("Migrating clicksA/clicksB columns into snapshot_clicks")
+
+	for _, stmt := range []string{
+		`INSERT OR IGNORE INTO snapshot_clicks(ts, option, clicks) SELECT ts, 'A', clicksA FROM counter_snapshots`,
+		`INSERT OR IGNORE INTO snapshot_clicks(ts, option, clicks) SELECT ts, 'B', clicksB FROM counter_snapshots`,
+		`ALTER TABLE counter_snapshots DROP COLUMN clicksA`,
+		`ALTER TABLE counter_snapshots DROP COLUMN clicksB`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateContestColumn rebuilds snapshot tables created before user contests
+// existed. The old table is renamed, the schema recreates it with the contest
+// column and the rows are copied over to the main contest, whose slug is empty.
+func migrateContestColumn(tx *sql.Tx, schema string) error {
+	tables := []struct{ name, columns string }{
+		{"counter_snapshots", "ts, views"},
+		{"snapshot_clicks", "ts, option, clicks"},
+	}
+	for _, t := range tables {
+		has, err := hasColumn(tx, t.name, "contest")
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		log.Println("Adding contest column to", t.name)
+
+		for _, stmt := range []string{
+			`ALTER TABLE ` + t.name + ` RENAME TO ` + t.name + `_legacy`,
+			schema,
+			`INSERT INTO ` + t.name + `(` + t.columns + `) SELECT ` + t.columns + ` FROM ` + t.name + `_legacy`,
+			`DROP TABLE ` + t.name + `_legacy`,
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func hasColumn(db querier, table, column string) (bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
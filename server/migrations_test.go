@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tableExists(t *testing.T, db DB, name string) bool {
+	t.Helper()
+	return countRows(t, db, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name) == 1
+}
+
+func TestLoadMigrationsIsOrderedAndComplete(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Name == "" || m.Up == "" || m.Down == "" {
+			t.Errorf("migration %d: got %d %q, up %d bytes, down %d bytes", i, m.Version, m.Name, len(m.Up), len(m.Down))
+		}
+	}
+}
+
+func TestOpenDBAppliesEveryMigrationOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clicks.db")
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, _ := loadMigrations()
+	if n := countRows(t, db, `SELECT COUNT(*) FROM schema_migrations`); n != int64(len(migrations)) {
+		t.Fatalf("schema_migrations: want %d rows, got %d", len(migrations), n)
+	}
+	db.Close()
+
+	// Reopening is a no-op.
+	db, err = openDB(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if n := countRows(t, db, `SELECT COUNT(*) FROM schema_migrations`); n != int64(len(migrations)) {
+		t.Fatalf("schema_migrations after reopen: want %d rows, got %d", len(migrations), n)
+	}
+}
+
+func TestMigrateRollbackAndReapply(t *testing.T) {
+	db := newTestDB(t)
+	migrations, _ := loadMigrations()
+
+	done, err := migrateDown(db.DB, migrations, 2)
+	if err != nil || len(done) != 2 || done[0].Name != "admin_audit" || done[1].Name != "replica_counts" {
+		t.Fatalf("rollback: got %+v, err %v", done, err)
+	}
+	if tableExists(t, db, "admin_audit") || tableExists(t, db, "replica_counts") {
+		t.Fatal("rolled back tables should be dropped")
+	}
+	if !tableExists(t, db, "milestones") {
+		t.Fatal("older tables should stay")
+	}
+
+	done, err = migrateUp(db.DB, migrations, 6)
+	if err != nil || len(done) != 1 || done[0].Name != "replica_counts" {
+		t.Fatalf("up to 6: got %+v, err %v", done, err)
+	}
+	done, err = migrateUp(db.DB, migrations, 0)
+	if err != nil || len(done) != 1 || !tableExists(t, db, "admin_audit") {
+		t.Fatalf("up: got %+v, err %v", done, err)
+	}
+}
+
+func TestFailedMigrationLeavesNoTrace(t *testing.T) {
+	db := newTestDB(t)
+	err := applyMigration(db.DB, Migration{Version: 99, Name: "broken", Up: `
+		CREATE TABLE half_done (x INTEGER);
+		INSERT INTO no_such_table VALUES (1);`})
+	if err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if tableExists(t, db, "half_done") {
+		t.Fatal("a failed migration must be rolled back")
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM schema_migrations WHERE version = 99`); n != 0 {
+		t.Fatal("a failed migration must not be recorded")
+	}
+}
+
+func TestOpenDBRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clicks.db")
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`INSERT INTO schema_migrations(version, name, applied_at) VALUES (999, 'future', 0)`)
+	db.Close()
+
+	if _, err := openDB(path); err == nil || !strings.Contains(err.Error(), "999") {
+		t.Fatalf("want a schema version error, got %v", err)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clicks.db")
+	run := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := runCommand(append([]string{"migrate", "-db", path}, args...), &stdout, &stderr)
+		return code, stdout.String() + stderr.String()
+	}
+
+	if code, out := run("status"); code != 0 || !strings.Contains(out, "snapshots") || !strings.Contains(out, "pending") {
+		t.Fatalf("status on a new db: %d %s", code, out)
+	}
+	if code, out := run("up"); code != 0 || !strings.Contains(out, "applied 0007_admin_audit") {
+		t.Fatalf("up: %d %s", code, out)
+	}
+	if code, out := run("up"); code != 0 || !strings.Contains(out, "nothing to do") {
+		t.Fatalf("second up: %d %s", code, out)
+	}
+	if code, out := run("rollback"); code != 0 || !strings.Contains(out, "rolled back 0007_admin_audit") {
+		t.Fatalf("rollback: %d %s", code, out)
+	}
+	if code, out := run("status"); code != 0 || strings.Count(out, "pending") != 1 {
+		t.Fatalf("status after rollback: %d %s", code, out)
+	}
+	if code, _ := run("sideways"); code != 2 {
+		t.Fatalf("unknown action: want exit 2, got %d", code)
+	}
+	if code, _ := run("rollback", "-1"); code != 2 {
+		t.Fatalf("negative steps: want exit 2, got %d", code)
+	}
+}
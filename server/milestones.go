@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+const (
+	milestoneKindCount = "count"
+	milestoneKindLead  = "lead"
+	maxMilestoneName   = 32
+	hallOfMilestones   = 50
+)
+
+var (
+	errMilestoneToken   = errors.New("invalid milestone token")
+	errMilestoneExpired = errors.New("milestone token expired or already used")
+	errMilestoneClient  = errors.New("milestone belongs to another client")
+	errMilestoneTaken   = errors.New("milestone already recorded")
+)
+
+// Milestone is a notable click: reaching one of the configured counts, a
+// round number, or the click that put an option in the lead.
+type Milestone struct {
+	Contest string `json:"contest"`
+	Option  string `json:"option"`
+	Count   int64  `json:"count"`
+	Kind    string `json:"kind"`
+}
+
+// detectMilestone reports whether the click that brought option to count is
+// notable. Counters are read one at a time, so under heavy concurrency the
+// lead check is best effort.
+func (app *App) detectMilestone(option string, count int64) *Milestone {
+	config := app.configuration.milestones
+	milestone := &Milestone{Contest: app.slug(), Option: option, Count: count, Kind: milestoneKindCount}
+	for _, target := range config.counts {
+		if count == target {
+			return milestone
+		}
+	}
+	if config.every > 0 && count%config.every == 0 {
+		return milestone
+	}
+
+	if config.leadMin > 0 && count >= config.leadMin {
+		var best int64
+		for other, n := range app.clicks.Snapshot() {
+			if other != option && n > best {
+				best = n
+			}
+		}
+		if count > best && count-1 <= best {
+			milestone.Kind = milestoneKindLead
+			return milestone
+		}
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////
+// Tokens
+
+// MilestoneTokens hands out signed, single use tokens proving a client made a
+// milestone click. The signature stops forged tokens; the pending set makes
+// each token redeemable once and only until it expires.
+type MilestoneTokens struct {
+	sync.Mutex
+	secret  []byte
+	ttl     time.Duration
+	pending map[string]time.Time // nonce -> expiry
+	now     func() time.Time
+}
+
+type milestoneClaim struct {
+	Milestone
+	Client  string `json:"client"`
+	Expires int64  `json:"exp"`
+	Nonce   string `json:"nonce"`
+}
+
+func NewMilestoneTokens(secret string, ttl time.Duration) *MilestoneTokens {
+	if secret == "" {
+		secret = randomSalt()
+	}
+	return &MilestoneTokens{
+		secret:  []byte(secret),
+		ttl:     ttl,
+		pending: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+func (t *MilestoneTokens) Issue(m Milestone, client string) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	now := t.now()
+	claim := milestoneClaim{
+		Milestone: m,
+		Client:    client,
+		Expires:   now.Add(t.ttl).Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	payload, err := json.Marshal(claim)
+	if err != nil {
+		return "", err
+	}
+
+	t.Lock()
+	for n, expires := range t.pending {
+		if now.After(expires) {
+			delete(t.pending, n)
+		}
+	}
+	t.pending[claim.Nonce] = now.Add(t.ttl)
+	t.Unlock()
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + t.sign(payload), nil
+}
+
+// Redeem checks the token and that client is the one it was issued to, then
+// spends it.
+func (t *MilestoneTokens) Redeem(token, client string) (Milestone, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Milestone{}, errMilestoneToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(t.sign(payload))) {
+		return Milestone{}, errMilestoneToken
+	}
+	var claim milestoneClaim
+	if err := json.Unmarshal(payload, &claim); err != nil {
+		return Milestone{}, errMilestoneToken
+	}
+	if claim.Client != client {
+		return Milestone{}, errMilestoneClient
+	}
+
+	now := t.now()
+	t.Lock()
+	defer t.Unlock()
+	expires, ok := t.pending[claim.Nonce]
+	if !ok || now.Unix() > claim.Expires || now.After(expires) {
+		return Milestone{}, errMilestoneExpired
+	}
+	delete(t.pending, claim.Nonce)
+	return claim.Milestone, nil
+}
+
+func (t *MilestoneTokens) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/////////////////////////////////////////////////////////////
+// Handlers
+
+type MilestoneSignals struct {
+	Token string `json:"milestoneToken"`
+	Name  string `json:"milestoneName"`
+}
+
+// promptMilestone asks the clicker for a display name. It is sent on the
+// response to the milestone click itself, so only that client sees it.
+func (app *App) promptMilestone(sse *datastar.ServerSentEventGenerator, m *Milestone, client string) error {
+	token, err := app.milestoneTokens.Issue(*m, client)
+	if err != nil {
+		return err
+	}
+	err = sse.MergeFragments(`
+      <div id="modal-content">
+        <h2>You made a milestone!</h2>
+        <p>` + html.EscapeString(app.describeMilestone(*m)) + `</p>
+        <p>Leave your name in the Hall of milestones:</p>
+        <input type="text" maxlength="32" placeholder="Display name" data-bind-milestone-name />
+        <button data-on-click="@post('milestones/claim')">Record it</button>
+        <a href="#" data-on-click="@get('modal/toggle')">Hide</a>
+      </div>
+	`)
+	if err != nil {
+		return err
+	}
+	return sse.MarshalAndMergeSignals(&Signal{
+		"showModal":      true,
+		"milestoneToken": token,
+		"milestoneName":  "",
+	})
+}
+
+func (app *App) claimMilestoneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var signals MilestoneSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		http.Error(w, "invalid signals", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(signals.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxMilestoneName {
+		claimNotice(w, r, fmt.Sprintf("Names must be 1-%d characters.", maxMilestoneName))
+		return
+	}
+
+	client := app.configuration.anonymizeClient(app.configuration.clientIP(r))
+	milestone, err := app.milestoneTokens.Redeem(signals.Token, client)
+	if err == nil && milestone.Contest != app.slug() {
+		err = errMilestoneToken
+	}
+	if err == nil {
+		err = app.db.InsertMilestone(milestone, name, client)
+	}
+	switch {
+	case errors.Is(err, errMilestoneToken), errors.Is(err, errMilestoneClient):
+		claimNotice(w, r, "This milestone can't be claimed from here.")
+		return
+	case errors.Is(err, errMilestoneExpired):
+		claimNotice(w, r, "Too late, this milestone has expired or was already claimed.")
+		return
+	case errors.Is(err, errMilestoneTaken):
+		claimNotice(w, r, "Someone already put their name on this milestone.")
+		return
+	case err != nil:
+		log.Println("Error recording milestone:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	err = sse.MergeFragments(`
+      <div id="modal-content">
+        <h2>Recorded!</h2>
+        <p>` + html.EscapeString(name) + ` &mdash; ` + html.EscapeString(app.describeMilestone(milestone)) + `</p>
+        <a href="#" data-on-click="@get('milestones')">Hall of milestones</a>
+        <a href="#" data-on-click="@get('modal/toggle')">Hide</a>
+      </div>
+	`)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := sse.MarshalAndMergeSignals(&Signal{"milestoneToken": "", "milestoneName": ""}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// claimNotice answers a claim that can't be recorded with a notice in the
+// modal, which a plain error response would never reach.
+func claimNotice(w http.ResponseWriter, r *http.Request, notice string) {
+	sse := datastar.NewSSE(w, r)
+	if err := sse.MarshalAndMergeSignals(&Signal{"notice": notice}); err != nil {
+		log.Println("sse error claiming milestone:", err)
+	}
+}
+
+func (app *App) milestonesHandler(w http.ResponseWriter, r *http.Request) {
+	recorded, err := app.db.Milestones(app.slug(), hallOfMilestones)
+	if err != nil {
+		log.Println("Error fetching milestones:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	var rows strings.Builder
+	for _, m := range recorded {
+		fmt.Fprintf(&rows, "<li><strong>%s</strong> &mdash; %s <small>%s</small></li>\n",
+			html.EscapeString(m.Name),
+			html.EscapeString(app.describeMilestone(m.Milestone)),
+			time.Unix(m.Ts, 0).UTC().Format("Jan 2, 2006"))
+	}
+	if len(recorded) == 0 {
+		rows.WriteString("<li>No milestones yet. Keep clicking!</li>")
+	}
+
+	sse := datastar.NewSSE(w, r)
+	err = sse.MergeFragments(`
+      <div id="modal-content">
+        <h2>Hall of milestones</h2>
+        <ul class="milestones">` + rows.String() + `</ul>
+        <a href="#" data-on-click="@get('modal/toggle')">Hide</a>
+      </div>
+	`)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := sse.MarshalAndMergeSignals(&Signal{"showModal": true}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (app *App) describeMilestone(m Milestone) string {
+	label := m.Option
+	for _, o := range app.configuration.contest.Options {
+		if o.ID == m.Option {
+			label = o.DisplayName()
+		}
+	}
+	if m.Kind == milestoneKindLead {
+		return fmt.Sprintf("put %s in the lead with click #%d", label, m.Count)
+	}
+	return fmt.Sprintf("click #%d for %s", m.Count, label)
+}
+
+/////////////////////////////////////////////////////////////
+// Storage
+
+type RecordedMilestone struct {
+	Milestone
+	Name string
+	Ts   int64
+}
+
+func insertMilestone(db DB, m Milestone, name, client string) error {
+	res, err := db.ExecContext(context.Background(),
+		`INSERT OR IGNORE INTO milestones(contest, option, count, kind, name, client, ts)
+		VALUES (?,?,?,?,?,?,?)`,
+		m.Contest, m.Option, m.Count, m.Kind, name, client, time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errMilestoneTaken
+	}
+	return nil
+}
+
+func fetchMilestones(db DB, contest string, limit int) ([]RecordedMilestone, error) {
+	rows, err := db.Query(`
+		SELECT option, count, kind, name, ts
+		FROM   milestones
+		WHERE  contest = ?
+		ORDER  BY ts DESC, count DESC
+		LIMIT  ?`, contest, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []RecordedMilestone
+	for rows.Next() {
+		m := RecordedMilestone{Milestone: Milestone{Contest: contest}}
+		if err := rows.Scan(&m.Option, &m.Count, &m.Kind, &m.Name, &m.Ts); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newMilestoneApp(t *testing.T, config MilestoneConfig) *App {
+	t.Helper()
+	app := newTestApp()
+	app.db = newTestDB(t)
+	app.configuration.milestones = config
+	app.milestoneTokens = NewMilestoneTokens("secret", time.Minute)
+	return app
+}
+
+func claimRequest(token, name string) *http.Request {
+	signals := `{"milestoneToken":"` + token + `","milestoneName":"` + name + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/milestones/claim", strings.NewReader(signals))
+	r.Header.Set("datastar-request", "true")
+	return r
+}
+
+// ---------------------- detection ----------------------
+
+func TestDetectMilestone(t *testing.T) {
+	app := newTestApp()
+	app.configuration.milestones = MilestoneConfig{counts: []int64{3}, every: 10, leadMin: 2}
+
+	var got []Milestone
+	click := func(option string) {
+		if _, m, _ := app.Click(option, "client"); m != nil {
+			got = append(got, *m)
+		}
+	}
+	click("B") // B 1 is below leadMin
+	click("A") // A 1
+	click("A") // A 2 takes the lead
+	click("A") // A 3 is a configured count
+	for i := 0; i < 3; i++ {
+		click("B") // B 2..4, B 3 is a configured count and B 4 takes the lead
+	}
+	for i := 0; i < 6; i++ {
+		click("A") // A 4..9, A 5 takes the lead back
+	}
+	click("A") // A 10 is a round number
+
+	want := []Milestone{
+		{Option: "A", Count: 2, Kind: milestoneKindLead},
+		{Option: "A", Count: 3, Kind: milestoneKindCount},
+		{Option: "B", Count: 3, Kind: milestoneKindCount},
+		{Option: "B", Count: 4, Kind: milestoneKindLead},
+		{Option: "A", Count: 5, Kind: milestoneKindLead},
+		{Option: "A", Count: 10, Kind: milestoneKindCount},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("milestones: want %+v, got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("milestone %d: want %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestDetectMilestoneDisabled(t *testing.T) {
+	app := newTestApp()
+	for i := 0; i < 1000; i++ {
+		if _, m, _ := app.Click("A", "client"); m != nil {
+			t.Fatalf("click %d: unexpected milestone %+v", i, m)
+		}
+	}
+}
+
+// ---------------------- tokens ----------------------
+
+func TestMilestoneTokensAreSingleUse(t *testing.T) {
+	tokens := NewMilestoneTokens("secret", time.Minute)
+	m := Milestone{Option: "A", Count: 1000, Kind: milestoneKindCount}
+
+	token, err := tokens.Issue(m, "client-1")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if _, err := tokens.Redeem(token, "client-2"); err != errMilestoneClient {
+		t.Fatalf("other client: want errMilestoneClient, got %v", err)
+	}
+	got, err := tokens.Redeem(token, "client-1")
+	if err != nil || got != m {
+		t.Fatalf("redeem: want %+v, got %+v, err %v", m, got, err)
+	}
+	if _, err := tokens.Redeem(token, "client-1"); err != errMilestoneExpired {
+		t.Fatalf("second redeem: want errMilestoneExpired, got %v", err)
+	}
+}
+
+func TestMilestoneTokensRejectForgeries(t *testing.T) {
+	tokens := NewMilestoneTokens("secret", time.Minute)
+	token, _ := tokens.Issue(Milestone{Option: "A", Count: 1000}, "client")
+	forged, _ := NewMilestoneTokens("other", time.Minute).Issue(Milestone{Option: "A", Count: 1000}, "client")
+
+	payload, signature, _ := strings.Cut(token, ".")
+	for _, bad := range []string{"", "garbage", payload, payload + ".AAAA", "e30." + signature, forged} {
+		if _, err := tokens.Redeem(bad, "client"); err != errMilestoneToken {
+			t.Errorf("Redeem(%q): want errMilestoneToken, got %v", bad, err)
+		}
+	}
+}
+
+func TestMilestoneTokensExpire(t *testing.T) {
+	tokens := NewMilestoneTokens("secret", time.Minute)
+	now := time.Unix(1_700_000_000, 0)
+	tokens.now = func() time.Time { return now }
+
+	token, _ := tokens.Issue(Milestone{Option: "A", Count: 1000}, "client")
+	now = now.Add(2 * time.Minute)
+	if _, err := tokens.Redeem(token, "client"); err != errMilestoneExpired {
+		t.Fatalf("want errMilestoneExpired, got %v", err)
+	}
+}
+
+// ---------------------- handlers ----------------------
+
+var tokenPattern = regexp.MustCompile(`"milestoneToken":"([^"]+)"`)
+
+func TestMilestoneClickPromptsAndClaimRecords(t *testing.T) {
+	app := newMilestoneApp(t, MilestoneConfig{counts: []int64{2}})
+
+	click := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.clickHandler(rr, httptest.NewRequest(http.MethodPost, "/click/A", nil))
+		return rr
+	}
+	if body := click().Body.String(); strings.Contains(body, "milestoneToken") {
+		t.Fatalf("first click should not prompt: %s", body)
+	}
+	body := click().Body.String()
+	match := tokenPattern.FindStringSubmatch(body)
+	if match == nil || !strings.Contains(body, "You made a milestone!") {
+		t.Fatalf("second click should prompt for a name: %s", body)
+	}
+
+	claim := func(name, token string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.claimMilestoneHandler(rr, claimRequest(token, name))
+		return rr
+	}
+	if rr := claim("<b>Ann</b>", match[1]); rr.Code != http.StatusOK {
+		t.Fatalf("claim: want 200, got %d: %s", rr.Code, rr.Body)
+	}
+	if body := claim("Bob", match[1]).Body.String(); !strings.Contains(body, `"notice":"Too late`) {
+		t.Fatalf("reused token: want a notice, got %s", body)
+	}
+	if body := claim("Bob", "forged.token").Body.String(); !strings.Contains(body, `"notice":"This milestone can't`) {
+		t.Fatalf("forged token: want a notice, got %s", body)
+	}
+
+	recorded, err := app.db.Milestones("", 10)
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("fetchMilestones: got %+v, err %v", recorded, err)
+	}
+	if m := recorded[0]; m.Name != "<b>Ann</b>" || m.Option != "A" || m.Count != 2 {
+		t.Fatalf("recorded milestone: got %+v", m)
+	}
+
+	rr := httptest.NewRecorder()
+	app.milestonesHandler(rr, httptest.NewRequest(http.MethodGet, "/milestones", nil))
+	page := rr.Body.String()
+	if !strings.Contains(page, "&lt;b&gt;Ann&lt;/b&gt;") || strings.Contains(page, "<b>Ann") {
+		t.Fatalf("hall should list the escaped name: %s", page)
+	}
+}
+
+func TestClaimMilestoneRejectsBadNames(t *testing.T) {
+	app := newMilestoneApp(t, MilestoneConfig{counts: []int64{1}})
+	token, _ := app.milestoneTokens.Issue(Milestone{Option: "A", Count: 1, Kind: milestoneKindCount}, "client")
+
+	for _, name := range []string{"", "   ", strings.Repeat("x", maxMilestoneName+1)} {
+		rr := httptest.NewRecorder()
+		app.claimMilestoneHandler(rr, claimRequest(token, name))
+		if !strings.Contains(rr.Body.String(), "Names must be") {
+			t.Errorf("name %q: expected a notice, got %s", name, rr.Body)
+		}
+	}
+	if recorded, _ := app.db.Milestones("", 10); len(recorded) != 0 {
+		t.Fatalf("bad names must not be recorded: %+v", recorded)
+	}
+}
+
+func TestClaimMilestoneOfAnotherClientGetsNotice(t *testing.T) {
+	app := newMilestoneApp(t, MilestoneConfig{counts: []int64{1}})
+	token, _ := app.milestoneTokens.Issue(Milestone{Option: "A", Count: 1, Kind: milestoneKindCount}, "someone else")
+
+	rr := httptest.NewRecorder()
+	app.claimMilestoneHandler(rr, claimRequest(token, "Ann"))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "datastar-merge-signals") || !strings.Contains(rr.Body.String(), `"notice":`) {
+		t.Fatalf("want a notice signal, got %d: %s", rr.Code, rr.Body)
+	}
+	if recorded, _ := app.db.Milestones("", 10); len(recorded) != 0 {
+		t.Fatalf("another client's milestone must not be recorded: %+v", recorded)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Telemetry collects process wide counters for the /metrics endpoint that
+// don't belong to a single App.
+type Telemetry struct {
+	snapshotLatency *Histogram
+	snapshotErrors  atomic.Int64
+	backupSuccess   atomic.Int64
+	backupFailure   atomic.Int64
+	lastBackup      atomic.Int64 // unix seconds of the last successful backup
+	backupsPruned   atomic.Int64
+	pruneErrors     atomic.Int64
+	uploadSuccess   atomic.Int64
+	uploadFailure   atomic.Int64
+}
+
+var telemetry = NewTelemetry()
+
+func NewTelemetry() *Telemetry {
+	return &Telemetry{
+		snapshotLatency: NewHistogram([]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}),
+	}
+}
+
+func (t *Telemetry) recordBackup(err error) {
+	if err != nil {
+		t.backupFailure.Add(1)
+		return
+	}
+	t.backupSuccess.Add(1)
+	t.lastBackup.Store(time.Now().Unix())
+}
+
+func (t *Telemetry) recordUpload(err error) {
+	if err != nil {
+		t.uploadFailure.Add(1)
+		return
+	}
+	t.uploadSuccess.Add(1)
+}
+
+// Histogram is a minimal prometheus style histogram with fixed buckets.
+type Histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer, name, help string) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+/////////////////////////////////////////////////////////////
+// Exposition
+
+// metricsExporter serves the prometheus text format. It is mounted on its own
+// listener so the numbers are not public.
+type metricsExporter struct {
+	app      *App
+	contests *Contests
+}
+
+// launchMetrics starts the prometheus server, or returns nil when METRICS_ADDR
+// is not set.
+func launchMetrics(config *Configuration, app *App, contests *Contests) *http.Server {
+	if config.metricsAddr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &metricsExporter{app: app, contests: contests})
+
+	server := &http.Server{Addr: config.metricsAddr, Handler: mux}
+	log.Println("prometheus metrics listening on", config.metricsAddr)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("metrics server failed: %v", err)
+		}
+	}()
+	return server
+}
+
+func (e *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	apps := []*App{e.app}
+	if e.contests != nil {
+		apps = append(apps, e.contests.apps()...)
+	}
+
+	counter := func(name, help string) { writeHeader(w, name, help, "counter") }
+	gauge := func(name, help string) { writeHeader(w, name, help, "gauge") }
+
+	counter("clickthebutton_clicks_total", "Clicks per option of the main contest.")
+	clicks := e.app.clicks.Snapshot()
+	for _, option := range e.app.clicks.Options() {
+		fmt.Fprintf(w, "clickthebutton_clicks_total{option=\"%s\"} %d\n", escapeLabel(option), clicks[option])
+	}
+
+	counter("clickthebutton_views_total", "Home page views of the main contest.")
+	fmt.Fprintf(w, "clickthebutton_views_total %d\n", e.app.views.Load())
+
+	var contestClicks, streamClients, feedClients, socketClients, listeners, dropped, streamDropped, disconnects, worstDrops int64
+	for i, app := range apps {
+		if i > 0 {
+			for _, n := range app.clicks.Snapshot() {
+				contestClicks += n
+			}
+		}
+		streamClients += app.streamClients.Load()
+		feedClients += app.feedClients.Load()
+		socketClients += app.socketClients.Load()
+		listeners += int64(app.broadcaster.Len())
+		dropped += app.broadcaster.dropped.Load()
+		streamDropped += app.counterStream.dropped.Load()
+		disconnects += app.broadcaster.disconnected.Load() + app.counterStream.disconnected.Load()
+		worstDrops = max(worstDrops, app.broadcaster.worstDrops(), app.counterStream.worstDrops())
+	}
+
+	gauge("clickthebutton_contests", "User created contests being served.")
+	fmt.Fprintf(w, "clickthebutton_contests %d\n", len(apps)-1)
+
+	gauge("clickthebutton_contest_clicks", "Clicks across the user created contests being served.")
+	fmt.Fprintf(w, "clickthebutton_contest_clicks %d\n", contestClicks)
+
+	gauge("clickthebutton_stream_clients", "Connected /stream clients.")
+	fmt.Fprintf(w, "clickthebutton_stream_clients %d\n", streamClients)
+
+	gauge("clickthebutton_feed_clients", "Connected /metrics/feed clients.")
+	fmt.Fprintf(w, "clickthebutton_feed_clients %d\n", feedClients)
+
+	gauge("clickthebutton_websocket_clients", "Connected /ws clients.")
+	fmt.Fprintf(w, "clickthebutton_websocket_clients %d\n", socketClients)
+
+	gauge("clickthebutton_broadcast_listeners", "Broadcaster subscriptions.")
+	fmt.Fprintf(w, "clickthebutton_broadcast_listeners %d\n", listeners)
+
+	counter("clickthebutton_broadcast_dropped_total", "Points not delivered because a listener's buffer was full.")
+	fmt.Fprintf(w, "clickthebutton_broadcast_dropped_total %d\n", dropped)
+
+	counter("clickthebutton_stream_events_dropped_total", "Counter events not sent because a /stream connection fell behind.")
+	fmt.Fprintf(w, "clickthebutton_stream_events_dropped_total %d\n", streamDropped)
+
+	counter("clickthebutton_slow_client_disconnects_total", "Feed and stream connections closed for falling too far behind.")
+	fmt.Fprintf(w, "clickthebutton_slow_client_disconnects_total %d\n", disconnects)
+
+	gauge("clickthebutton_slow_client_worst_drops", "Most values missed by a single connected feed or stream client.")
+	fmt.Fprintf(w, "clickthebutton_slow_client_worst_drops %d\n", worstDrops)
+
+	counter("clickthebutton_clicks_rejected_total", "Clicks refused by the rate limiter.")
+	fmt.Fprintf(w, "clickthebutton_clicks_rejected_total %d\n", e.app.limiter.Rejected())
+
+	gauge("clickthebutton_rate_limited_clients", "Clients with a partly spent rate limit bucket.")
+	fmt.Fprintf(w, "clickthebutton_rate_limited_clients %d\n", e.app.limiter.Len())
+
+	if e.app.configuration.peers.enabled() {
+		gauge("clickthebutton_peers_reachable", "Peers that answered the last replication round.")
+		fmt.Fprintf(w, "clickthebutton_peers_reachable %d\n", e.app.peersReachable.Load())
+	}
+
+	telemetry.snapshotLatency.write(w, "clickthebutton_snapshot_write_seconds", "Time taken to write a snapshot.")
+
+	counter("clickthebutton_snapshot_errors_total", "Snapshots that failed to write.")
+	fmt.Fprintf(w, "clickthebutton_snapshot_errors_total %d\n", telemetry.snapshotErrors.Load())
+
+	counter("clickthebutton_backups_total", "Backups attempted by result.")
+	fmt.Fprintf(w, "clickthebutton_backups_total{result=\"success\"} %d\n", telemetry.backupSuccess.Load())
+	fmt.Fprintf(w, "clickthebutton_backups_total{result=\"failure\"} %d\n", telemetry.backupFailure.Load())
+
+	gauge("clickthebutton_last_backup_success_timestamp_seconds", "Unix time of the last successful backup.")
+	fmt.Fprintf(w, "clickthebutton_last_backup_success_timestamp_seconds %d\n", telemetry.lastBackup.Load())
+
+	counter("clickthebutton_backup_uploads_total", "Backups shipped to the backup sink by result.")
+	fmt.Fprintf(w, "clickthebutton_backup_uploads_total{result=\"success\"} %d\n", telemetry.uploadSuccess.Load())
+	fmt.Fprintf(w, "clickthebutton_backup_uploads_total{result=\"failure\"} %d\n", telemetry.uploadFailure.Load())
+
+	counter("clickthebutton_backups_pruned_total", "Old backups deleted by the retention policy.")
+	fmt.Fprintf(w, "clickthebutton_backups_pruned_total %d\n", telemetry.backupsPruned.Load())
+
+	counter("clickthebutton_backup_prune_errors_total", "Retention runs that failed to prune backups.")
+	fmt.Fprintf(w, "clickthebutton_backup_prune_errors_total %d\n", telemetry.pruneErrors.Load())
+
+	if clickLog := e.app.clickLog; clickLog != nil {
+		counter("clickthebutton_click_log_written_total", "Click events written to click_events.")
+		fmt.Fprintf(w, "clickthebutton_click_log_written_total %d\n", clickLog.written.Load())
+		counter("clickthebutton_click_log_dropped_total", "Click events dropped because the log buffer was full.")
+		fmt.Fprintf(w, "clickthebutton_click_log_dropped_total %d\n", clickLog.dropped.Load())
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExporterTextFormat(t *testing.T) {
+	app := newTestApp()
+	app.broadcaster = NewBroadcaster[Point](SlowConsumerPolicy{})
+	app.clicks.Store("A", 7)
+	app.clicks.Store("B", 3)
+	app.views.Store(42)
+	app.streamClients.Store(2)
+
+	sub := app.broadcaster.Subscribe()
+	defer app.broadcaster.Unsubscribe(sub)
+	for i := 0; i < cap(sub.C)+1; i++ {
+		app.broadcaster.Publish(Point{Ts: int64(i)})
+	}
+
+	h := NewHistogram([]float64{0.01, 0.1})
+	h.Observe(0.005)
+	h.Observe(0.05)
+	h.Observe(5)
+	var buf strings.Builder
+	h.write(&buf, "h", "help")
+
+	rr := httptest.NewRecorder()
+	(&metricsExporter{app: app}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want HTTP 200, got %d", rr.Code)
+	}
+	body := rr.Body.String() + buf.String()
+
+	for _, want := range []string{
+		"# TYPE clickthebutton_clicks_total counter",
+		`clickthebutton_clicks_total{option="A"} 7`,
+		`clickthebutton_clicks_total{option="B"} 3`,
+		"clickthebutton_views_total 42",
+		"# TYPE clickthebutton_contest_clicks gauge",
+		"clickthebutton_stream_clients 2",
+		"clickthebutton_broadcast_listeners 1",
+		"clickthebutton_broadcast_dropped_total 1",
+		"clickthebutton_slow_client_worst_drops 1",
+		"# TYPE clickthebutton_snapshot_write_seconds histogram",
+		`h_bucket{le="0.01"} 1`,
+		`h_bucket{le="0.1"} 2`,
+		`h_bucket{le="+Inf"} 3`,
+		"h_count 3",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+// RateLimiter is a token bucket per client. Each client may spend burst
+// tokens at once and gets rate tokens back per second. Buckets that have
+// refilled completely are forgotten by the sweeper since a fresh bucket is
+// identical.
+type RateLimiter struct {
+	sync.Mutex
+	rate     float64
+	burst    float64
+	buckets  map[string]*tokenBucket
+	rejected atomic.Int64
+	now      func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns nil when rate is not positive; a nil *RateLimiter
+// allows everything.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   math.Max(1, float64(burst)),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (l *RateLimiter) Allow(client string) bool {
+	if l == nil {
+		return true
+	}
+	now := l.now()
+
+	l.Lock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	l.Unlock()
+
+	if !allowed {
+		l.rejected.Add(1)
+	}
+	return allowed
+}
+
+// RetryAfter is how long a client with an empty bucket waits for one token.
+func (l *RateLimiter) RetryAfter() time.Duration {
+	return time.Duration(float64(time.Second) / l.rate)
+}
+
+func (l *RateLimiter) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	return len(l.buckets)
+}
+
+func (l *RateLimiter) Rejected() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.rejected.Load()
+}
+
+// sweep drops buckets that would be full by now.
+func (l *RateLimiter) sweep() {
+	now := l.now()
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+
+	l.Lock()
+	defer l.Unlock()
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *RateLimiter) evictPeriodically() {
+	if l == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			l.sweep()
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(2, 3) // 2 per second, burst of 3
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("burst click %d should be allowed", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("fourth click should be limited")
+	}
+	if !l.Allow("b") {
+		t.Fatal("other clients have their own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond) // one token back
+	if !l.Allow("a") || l.Allow("a") {
+		t.Fatal("half a second should refill exactly one token")
+	}
+	if got := l.Rejected(); got != 2 {
+		t.Fatalf("rejected: want 2, got %d", got)
+	}
+
+	// "b" refills after 1.5s, "a" spent a token at +0.5s
+	now = now.Add(1200 * time.Millisecond)
+	l.sweep()
+	if got := l.Len(); got != 1 {
+		t.Fatalf("sweep: want 1 bucket left, got %d", got)
+	}
+	now = now.Add(time.Second)
+	l.sweep()
+	if got := l.Len(); got != 0 {
+		t.Fatalf("sweep: want all buckets evicted, got %d", got)
+	}
+
+	var disabled *RateLimiter
+	if !disabled.Allow("a") {
+		t.Fatal("nil limiter should allow everything")
+	}
+}
+
+func TestClickHandlerRateLimited(t *testing.T) {
+	app := newTestApp()
+	app.limiter = NewRateLimiter(1, 2)
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/click/A", nil)
+		req.RemoteAddr = "203.0.113.9:4000"
+		rr := httptest.NewRecorder()
+		app.clickHandler(rr, req)
+		codes = append(codes, rr.Code)
+		if rr.Code == http.StatusTooManyRequests {
+			if rr.Header().Get("Retry-After") == "" || !strings.Contains(rr.Body.String(), "notice") {
+				t.Errorf("429 should carry Retry-After and a notice signal, got %q", rr.Body.String())
+			}
+		}
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("want 200, 200, 429, got %v", codes)
+	}
+	if got := app.clicks.Load("A"); got != 2 {
+		t.Fatalf("limited clicks must not count: want 2, got %d", got)
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	config := &Configuration{trustedProxies: proxies}
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		// direct client, header ignored
+		{"203.0.113.5:1", "198.51.100.1", "203.0.113.5"},
+		// via nginx
+		{"127.0.0.1:1", "198.51.100.1", "198.51.100.1"},
+		// spoofed entries left of the real client are ignored
+		{"127.0.0.1:1", "1.1.1.1, 198.51.100.1, 10.0.0.7", "198.51.100.1"},
+		// only proxies
+		{"127.0.0.1:1", "10.0.0.7", "10.0.0.7"},
+		// garbage stops the walk
+		{"127.0.0.1:1", "198.51.100.1, nonsense", "127.0.0.1"},
+		// no header
+		{"[::ffff:127.0.0.1]:1", "", "::ffff:127.0.0.1"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/click/A", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := config.clientIP(req); got != tc.want {
+			t.Errorf("remote %s xff %q: want %s, got %s", tc.remote, tc.xff, tc.want, got)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/99"); err == nil {
+		t.Error("invalid CIDR: want error")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Several nodes can serve the main contest behind one load balancer. Each
+// node counts its own clicks and every PEER_SYNC_INTERVAL posts its state to
+// each peer in PEERS, which merges it and answers with its own. Since merging
+// only ever raises counts, exchanges can be lost, repeated or reordered, and a
+// node cut off from the others catches up with the first exchange after it
+// rejoins. User contests are not replicated.
+
+// ReplicaState holds the clicks of one contest per node and option:
+// node -> option -> clicks.
+type ReplicaState map[string]map[string]int64
+
+// baseNode holds the clicks counted before replication was turned on. Nodes
+// restored from the same history agree on it, so it merges like any other
+// entry.
+const baseNode = ""
+
+// maxReplicaState bounds the body of a sync request or response.
+const maxReplicaState = 1 << 20
+
+// ---------- G-counter -------------
+
+// GCounter is a grow-only counter per option, split by the node that counted
+// the clicks. A node only raises its own entries, so two states merge by
+// keeping the larger value of every entry and the total of an option is the
+// sum over nodes.
+type GCounter struct {
+	sync.Mutex
+	node   string
+	counts ReplicaState
+}
+
+func (g *GCounter) add(option string, delta int64) {
+	g.raise(g.node, option, g.counts[g.node][option]+delta)
+}
+
+// raise sets an entry to n if that is larger and returns how much it grew.
+func (g *GCounter) raise(node, option string, n int64) int64 {
+	options, ok := g.counts[node]
+	if !ok {
+		options = make(map[string]int64)
+		g.counts[node] = options
+	}
+	diff := n - options[option]
+	if diff <= 0 {
+		return 0
+	}
+	options[option] = n
+	return diff
+}
+
+func (g *GCounter) total(option string) int64 {
+	var n int64
+	for _, options := range g.counts {
+		n += options[option]
+	}
+	return n
+}
+
+// Replicate starts keeping per node counts, with node as this node, from
+// state, and sets every total to the sum of its nodes. It must be called
+// before the counters are shared.
+func (c *Counters) Replicate(node string, state ReplicaState) {
+	c.replica = &GCounter{node: node, counts: make(ReplicaState)}
+	c.replica.merge(state)
+	for _, id := range c.options {
+		c.clicks[id].Store(c.replica.total(id))
+	}
+}
+
+func (g *GCounter) merge(state ReplicaState) {
+	for node, options := range state {
+		for option, n := range options {
+			g.raise(node, option, n)
+		}
+	}
+}
+
+// Merge folds a peer's state into the counters and returns how many clicks
+// it added. Options this contest doesn't have are kept and passed on, but
+// not counted.
+func (c *Counters) Merge(state ReplicaState) int64 {
+	if c.replica == nil {
+		return 0
+	}
+	c.replica.Lock()
+	defer c.replica.Unlock()
+	var added int64
+	for node, options := range state {
+		for option, n := range options {
+			diff := c.replica.raise(node, option, n)
+			if counter, ok := c.clicks[option]; ok && diff > 0 {
+				counter.Add(diff)
+				added += diff
+			}
+		}
+	}
+	return added
+}
+
+func (c *Counters) Replicated() bool {
+	return c.replica != nil
+}
+
+// ReplicaState returns a copy of the per node counts, or nil when the
+// counters aren't replicated.
+func (c *Counters) ReplicaState() ReplicaState {
+	if c.replica == nil {
+		return nil
+	}
+	c.replica.Lock()
+	defer c.replica.Unlock()
+	state := make(ReplicaState, len(c.replica.counts))
+	for node, options := range c.replica.counts {
+		state[node] = maps.Clone(options)
+	}
+	return state
+}
+
+// ---------- Peers -------------
+
+// replicate restores the per node counts saved with the last snapshot. The
+// first time a contest is replicated there are none and everything counted
+// so far becomes the base entry.
+//
+// Every process start counts under an entry of its own, node followed by a
+// random suffix. After a crash the saved counts can be older than what the
+// peers hold for this node, and clicks counted on top of them would vanish
+// in the merge until they caught up.
+func (app *App) replicate(node string, snapshot map[string]int64) {
+	state, err := app.db.ReplicaCounts(app.slug())
+	if err != nil {
+		log.Println("Error fetching replica counts:", err)
+	}
+	if len(state) == 0 {
+		state = ReplicaState{baseNode: snapshot}
+	}
+	app.clicks.Replicate(node+"#"+randomSalt()[:8], state)
+}
+
+// saveReplica stores state after the snapshot it was read before. Reading it
+// first means a crash can lose the clicks of the last moments, like an
+// unreplicated snapshot, but never counts the replayed click log twice.
+func (app *App) saveReplica(state ReplicaState) {
+	if state == nil {
+		return
+	}
+	if err := app.db.SaveReplicaCounts(app.slug(), state); err != nil {
+		log.Println("Error saving replica counts:", err)
+	}
+}
+
+func (app *App) syncPeersPeriodically() {
+	peers := app.configuration.peers
+	if !peers.enabled() {
+		return
+	}
+	client := &http.Client{Timeout: max(peers.interval, 2*time.Second)}
+	app.workers.Add(1)
+	go func() {
+		defer app.workers.Done()
+		ticker := time.NewTicker(peers.interval)
+		defer ticker.Stop()
+
+		reachable := make(map[string]bool)
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			var up int64
+			for _, peer := range peers.urls {
+				err := app.syncPeer(client, peer)
+				if was, seen := reachable[peer]; !seen || was != (err == nil) {
+					if err != nil {
+						log.Println("peer unreachable:", err)
+					} else {
+						log.Println("peer reachable:", peer)
+					}
+				}
+				reachable[peer] = err == nil
+				if err == nil {
+					up++
+				}
+			}
+			app.peersReachable.Store(up)
+		}
+	}()
+}
+
+// syncPeer sends this node's state to peer and merges the state it answers
+// with, so one exchange brings both up to date.
+func (app *App) syncPeer(client *http.Client, peer string) error {
+	body, err := json.Marshal(app.clicks.ReplicaState())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+"/peers/sync", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := app.configuration.peers.secret; secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", peer, resp.Status)
+	}
+	var state ReplicaState
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReplicaState)).Decode(&state); err != nil {
+		return fmt.Errorf("%s: %w", peer, err)
+	}
+	if app.clicks.Merge(state) > 0 {
+		app.touch()
+	}
+	return nil
+}
+
+// peerSyncHandler is the other half of syncPeer: it merges the posted state
+// and answers with its own. Merged counts can never be taken back, so only
+// peers that know PEER_SECRET get in.
+func (app *App) peerSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := app.configuration.peers.secret
+	given := r.Header.Get("Authorization")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var state ReplicaState
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReplicaState)).Decode(&state); err != nil {
+		http.Error(w, "bad replica state", http.StatusBadRequest)
+		return
+	}
+	if app.clicks.Merge(state) > 0 {
+		app.touch()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(app.clicks.ReplicaState()); err != nil {
+		log.Println("Error answering peer sync:", err)
+	}
+}
+
+// ---------- Storage -------------
+
+func fetchReplicaCounts(db DB, contest string) (ReplicaState, error) {
+	rows, err := db.Query(`SELECT node, option, clicks FROM replica_counts WHERE contest = ?`, contest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	state := make(ReplicaState)
+	for rows.Next() {
+		var node, option string
+		var clicks int64
+		if err := rows.Scan(&node, &option, &clicks); err != nil {
+			return nil, err
+		}
+		if state[node] == nil {
+			state[node] = make(map[string]int64)
+		}
+		state[node][option] = clicks
+	}
+	return state, rows.Err()
+}
+
+// saveReplicaCounts stores state, never lowering a count that is already
+// stored.
+func saveReplicaCounts(db DB, contest string, state ReplicaState) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for node, options := range state {
+		for option, clicks := range options {
+			if _, err := tx.Exec(`
+				INSERT INTO replica_counts(contest, node, option, clicks) VALUES (?,?,?,?)
+				ON CONFLICT(contest, node, option) DO UPDATE SET clicks = MAX(clicks, excluded.clicks)`,
+				contest, node, option, clicks); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newReplicatedApp(node string, store Store) *App {
+	app := newTestApp()
+	app.db = store
+	app.configuration.peers = PeerConfig{node: node, urls: []string{"unused"}, interval: time.Second, secret: "s3cret"}
+	latest, _, _ := store.LatestSnapshot(app.slug())
+	app.clicks.StoreAll(latest.Clicks)
+	app.replicate(node, latest.Clicks)
+	return app
+}
+
+func TestGCounterMergeConverges(t *testing.T) {
+	nodes := []*Counters{NewCounters([]string{"A", "B"}), NewCounters([]string{"A", "B"}), NewCounters([]string{"A", "B"})}
+	for i, c := range nodes {
+		c.Replicate(string(rune('a'+i)), ReplicaState{baseNode: {"A": 10}})
+		for j := 0; j <= i; j++ {
+			c.Add("B", 1)
+		}
+	}
+	// Any order, any number of times.
+	nodes[0].Merge(nodes[1].ReplicaState())
+	nodes[2].Merge(nodes[0].ReplicaState())
+	nodes[2].Merge(nodes[0].ReplicaState())
+	nodes[1].Merge(nodes[2].ReplicaState())
+	nodes[0].Merge(nodes[1].ReplicaState())
+
+	want := map[string]int64{"A": 10, "B": 6}
+	for i, c := range nodes {
+		if got := c.Snapshot(); !reflect.DeepEqual(got, want) {
+			t.Errorf("node %d: want %v, got %v", i, want, got)
+		}
+	}
+	if added := nodes[0].Merge(nodes[2].ReplicaState()); added != 0 {
+		t.Errorf("merging a known state again added %d clicks", added)
+	}
+}
+
+// peerServer serves app's /peers/sync and fails while offline is set.
+func peerServer(t *testing.T, app *App, offline *atomic.Bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if offline.Load() {
+			http.Error(w, "partitioned", http.StatusServiceUnavailable)
+			return
+		}
+		app.peerSyncHandler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPeersConvergeAfterPartition(t *testing.T) {
+	a := newReplicatedApp("a", NewMemoryStore())
+	b := newReplicatedApp("b", NewMemoryStore())
+	var offline atomic.Bool
+	srv := peerServer(t, b, &offline)
+	client := &http.Client{Timeout: time.Second}
+
+	a.Click("A", "x")
+	b.Click("B", "y")
+	if err := a.syncPeer(client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"A": 1, "B": 1}
+	if !reflect.DeepEqual(a.clicks.Snapshot(), want) || !reflect.DeepEqual(b.clicks.Snapshot(), want) {
+		t.Fatalf("one exchange should sync both: a %v, b %v", a.clicks.Snapshot(), b.clicks.Snapshot())
+	}
+
+	offline.Store(true)
+	for i := 0; i < 3; i++ {
+		a.Click("A", "x")
+		b.Click("A", "y")
+	}
+	if err := a.syncPeer(client, srv.URL); err == nil {
+		t.Fatal("sync during the partition should fail")
+	}
+	if a.clicks.Load("A") != 4 || b.clicks.Load("A") != 4 {
+		t.Fatalf("partitioned nodes only see their own clicks: a %d, b %d", a.clicks.Load("A"), b.clicks.Load("A"))
+	}
+
+	offline.Store(false)
+	if err := a.syncPeer(client, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int64{"A": 7, "B": 1}
+	if !reflect.DeepEqual(a.clicks.Snapshot(), want) || !reflect.DeepEqual(b.clicks.Snapshot(), want) {
+		t.Fatalf("nodes should converge: a %v, b %v", a.clicks.Snapshot(), b.clicks.Snapshot())
+	}
+}
+
+func TestPeerSyncRequiresSecret(t *testing.T) {
+	a := newReplicatedApp("a", NewMemoryStore())
+	b := newReplicatedApp("b", NewMemoryStore())
+	srv := httptest.NewServer(http.HandlerFunc(b.peerSyncHandler))
+	defer srv.Close()
+	client := &http.Client{Timeout: time.Second}
+
+	a.Click("A", "x")
+	a.configuration.peers.secret = "guess"
+	if err := a.syncPeer(client, srv.URL); err == nil || b.clicks.Load("A") != 0 {
+		t.Fatalf("sync with the wrong secret should be refused, err %v", err)
+	}
+	a.configuration.peers.secret = "s3cret"
+	if err := a.syncPeer(client, srv.URL); err != nil || b.clicks.Load("A") != 1 {
+		t.Fatalf("sync with the secret: err %v, b has %d", err, b.clicks.Load("A"))
+	}
+
+	// A node without a secret accepts nobody, not everybody.
+	a.Click("A", "x")
+	a.configuration.peers.secret = ""
+	b.configuration.peers.secret = ""
+	if err := a.syncPeer(client, srv.URL); err == nil || b.clicks.Load("A") != 1 {
+		t.Fatalf("sync to a node without a secret should be refused, err %v", err)
+	}
+}
+
+func TestPeersNeedSecret(t *testing.T) {
+	config := &Configuration{peers: PeerConfig{node: "a", urls: []string{"http://10.0.0.2:8080"}}}
+	if err := config.validate(); err == nil {
+		t.Fatal("PEERS without PEER_SECRET should be refused")
+	}
+	config.peers.secret = "s3cret"
+	if err := config.validate(); err != nil {
+		t.Fatalf("PEERS with PEER_SECRET: %v", err)
+	}
+}
+
+func TestReplicaSurvivesRestart(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertSnapshot("", 100, map[string]int64{"A": 50, "B": 5}, 0)
+
+	a := newReplicatedApp("a", store)
+	peer := newReplicatedApp("b", NewMemoryStore())
+	a.Click("A", "x")
+	peer.Click("B", "y")
+	a.clicks.Merge(peer.clicks.ReplicaState())
+	if err := a.finalSnapshot(time.Unix(200, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newReplicatedApp("a", store)
+	want := map[string]int64{"A": 51, "B": 6}
+	if got := restarted.clicks.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after restart: want %v, got %v", want, got)
+	}
+	if added := restarted.clicks.Merge(peer.clicks.ReplicaState()); added != 0 {
+		t.Fatalf("the peer's clicks were counted twice: %d added", added)
+	}
+}
+
+func TestClicksAfterCrashReachPeers(t *testing.T) {
+	store := NewMemoryStore()
+	a := newReplicatedApp("a", store)
+	peer := newReplicatedApp("b", NewMemoryStore())
+	if err := a.finalSnapshot(time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		a.Click("A", "x")
+	}
+	peer.clicks.Merge(a.clicks.ReplicaState())
+
+	// a crashes before saving its five clicks and comes back.
+	restarted := newReplicatedApp("a", store)
+	restarted.Click("A", "x")
+	if added := peer.clicks.Merge(restarted.clicks.ReplicaState()); added != 1 {
+		t.Fatalf("the click after the restart should reach the peer, %d added", added)
+	}
+	restarted.clicks.Merge(peer.clicks.ReplicaState())
+	if got := restarted.clicks.Snapshot()["A"]; got != 6 {
+		t.Fatalf("want 6 clicks after syncing, got %d", got)
+	}
+}
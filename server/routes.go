@@ -2,23 +2,34 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	datastar "github.com/starfederation/datastar/sdk/go"
 	"github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
 )
 
 type Signal map[string]any
 
 type HomePageSignals struct {
-	Message   string `json:"message"`
-	CounterA  int64  `json:"counterA"`
-	CounterB  int64  `json:"counterB"`
-	ShowModal bool   `json:"showModal"`
+	Message   string           `json:"message"`
+	Notice    string           `json:"notice"`
+	Counters  map[string]int64 `json:"counters"`
+	ShowModal bool             `json:"showModal"`
+}
+
+type HomePageData struct {
+	Signals string
+	Options []Option
 }
 
 /////////////////////////////////////////////////////////////
@@ -26,10 +37,10 @@ type HomePageSignals struct {
 
 func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) {
 	app.views.Add(1)
+	app.touch()
 	signal := HomePageSignals{
-		Message:   greeting,
-		CounterA:  app.clicksA.Load(),
-		CounterB:  app.clicksB.Load(),
+		Message:   app.message(),
+		Counters:  app.clicks.Snapshot(),
 		ShowModal: false,
 	}
 
@@ -37,7 +48,13 @@ func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	_ = tmpl.ExecuteTemplate(w, "home", string(bytes))
+	err = site.render(w, "home", HomePageData{
+		Signals: string(bytes),
+		Options: app.configuration.contest.Options,
+	})
+	if err != nil {
+		log.Println("Error rendering home page:", err)
+	}
 }
 
 //////////////////////////////////////////////////////////////
@@ -107,12 +124,32 @@ func (app *App) chartHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 		return
 	}
-	if err := sse.ExecuteScript(`setupChart();`); err != nil {
+	options, err := json.Marshal(chartSeriesFor(app.configuration.contest.Options))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := sse.ExecuteScript(`setupChart(` + string(options) + `);`); err != nil {
 		fmt.Println(err)
 		return
 	}
 }
 
+// chartSeries is what setupChart needs to draw one option.
+type chartSeries struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+func chartSeriesFor(options []Option) []chartSeries {
+	series := make([]chartSeries, len(options))
+	for i, o := range options {
+		series[i] = chartSeries{ID: o.ID, Name: o.DisplayName(), Color: o.Color}
+	}
+	return series
+}
+
 func (app *App) modalToggle(w http.ResponseWriter, r *http.Request) {
 	var signals HomePageSignals
 	if err := datastar.ReadSignals(r, &signals); err != nil {
@@ -136,69 +173,151 @@ func (app *App) clickHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch path.Base(r.URL.Path) {
-	case "A":
-		signal := app.ClickA()
-		sse := datastar.NewSSE(w, r)
-		if err := sse.MarshalAndMergeSignals(&signal); err != nil {
-			log.Println("sse error clickA:", err)
+	option := path.Base(r.URL.Path)
+	signal, milestone, client, err := app.clickFrom(app.configuration.clientIP(r), option)
+	switch err {
+	case errDraining:
+		rejectDraining(w)
+		return
+	case errUnknownOption:
+		http.NotFound(w, r)
+		return
+	case errRateLimited:
+		app.rejectClick(w, r)
+		return
+	case errPaused:
+		rejectPaused(w, r)
+		return
+	}
+	signal["notice"] = ""
+	sse := datastar.NewSSE(w, r)
+	if err := sse.MarshalAndMergeSignals(&signal); err != nil {
+		log.Println("sse error click"+option+":", err)
+	}
+	if milestone != nil {
+		if err := app.promptMilestone(sse, milestone, client); err != nil {
+			log.Println("sse error prompting milestone:", err)
 		}
+	}
+}
 
-	case "B":
-		signal := app.ClickB()
-		sse := datastar.NewSSE(w, r)
-		if err := sse.MarshalAndMergeSignals(&signal); err != nil {
-			log.Println("sse error clickB:", err)
-		}
+const slowDownNotice = "Whoa, slow down! Some of your clicks weren't counted."
 
-	default:
-		http.NotFound(w, r)
+// rejectClick answers a rate limited click with 429. The body is still a
+// datastar event stream so the page can show $notice to the clicker.
+func (app *App) rejectClick(w http.ResponseWriter, r *http.Request) {
+	retryAfter := int(math.Ceil(app.limiter.RetryAfter().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	sse := datastar.NewSSE(w, r)
+	if err := sse.MarshalAndMergeSignals(&Signal{"notice": slowDownNotice}); err != nil {
+		log.Println("sse error rejecting click:", err)
 	}
 }
 
-func (app *App) ClickA() Signal {
-	count := app.clicksA.Add(1)
-	return Signal{"counterA": count}
+const pausedNotice = "Clicking is paused for a moment."
+
+// rejectPaused answers clicks while an admin has paused clicking, with a
+// notice like a rate limited click.
+func rejectPaused(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	sse := datastar.NewSSE(w, r)
+	if err := sse.MarshalAndMergeSignals(&Signal{"notice": pausedNotice}); err != nil {
+		log.Println("sse error rejecting paused click:", err)
+	}
 }
 
-func (app *App) ClickB() Signal {
-	count := app.clicksB.Add(1)
-	return Signal{"counterB": count}
+var (
+	errDraining      = errors.New("shutting down")
+	errUnknownOption = errors.New("unknown option")
+	errRateLimited   = errors.New("rate limited")
+	errPaused        = errors.New("clicking is paused")
+)
+
+// clickFrom is the click path of every transport: it refuses clicks while
+// draining, for unknown options and over the rate limit of ip, then counts
+// the click for the anonymized client.
+func (app *App) clickFrom(ip, option string) (Signal, *Milestone, string, error) {
+	if app.isDraining() {
+		return nil, nil, "", errDraining
+	}
+	if app.paused.Load() {
+		return nil, nil, "", errPaused
+	}
+	if !app.clicks.Has(option) {
+		return nil, nil, "", errUnknownOption
+	}
+	if !app.limiter.Allow(ip) {
+		return nil, nil, "", errRateLimited
+	}
+	client := app.configuration.anonymizeClient(ip)
+	signal, milestone, ok := app.Click(option, client)
+	if !ok {
+		return nil, nil, "", errUnknownOption
+	}
+	return signal, milestone, client, nil
+}
+
+// Click counts a click for option. The milestone is non-nil when this click
+// was a notable one.
+func (app *App) Click(option, client string) (Signal, *Milestone, bool) {
+	count, ok := app.clicks.Add(option, 1)
+	if !ok {
+		return nil, nil, false
+	}
+	app.touch()
+	app.clickLog.Record(ClickEvent{
+		Ts:      time.Now().UnixMilli(),
+		Contest: app.slug(),
+		Option:  option,
+		Client:  client,
+	})
+	return Signal{"counters": Signal{option: count}}, app.detectMilestone(option, count), true
 }
 
 /////////////////////////////////////////////////////////////
 // Stream
 
+// streamHandler forwards the events of the counter publisher. It starts with
+// the current counts so the page is right even if nothing changes for a while.
 func (app *App) streamHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Accel-Buffering", "no")
 	sse := datastar.NewSSE(w, r)
+	rc := http.NewResponseController(w)
+	app.touch()
+	app.streamClients.Add(1)
+	defer app.streamClients.Add(-1)
 
-	signal := Signal{}
-	previousA := int64(0)
-	previousB := int64(0)
-	ticker := time.NewTicker(100 * time.Millisecond)
+	sub := app.counterStream.Subscribe()
+	defer app.counterStream.Unsubscribe(sub)
+
+	signals := app.liveSignals(app.clicks.Snapshot())
+	if err := sse.MarshalAndMergeSignals(&signals); err != nil {
+		return
+	}
 	for {
 		select {
 		case <-r.Context().Done():
 			return
-		case <-ticker.C:
-			countA := app.clicksA.Load()
-			if previousA != countA {
-				previousA = countA
-				signal["counterA"] = countA
-				err := sse.MarshalAndMergeSignals(&signal)
-				if err != nil {
-					fmt.Println(err)
-				}
+		case <-app.draining:
+			askStreamToReconnect(sse, "stream")
+			return
+		case event, ok := <-sub.C:
+			if !ok { // fell too far behind
+				askStreamToReconnect(sse, "stream")
+				return
+			}
+			if _, err := w.Write(event.sse); err != nil {
+				return
 			}
-			countB := app.clicksB.Load()
-			if previousB != countB {
-				previousB = countB
-				signal["counterB"] = countB
-				err := sse.MarshalAndMergeSignals(&signal)
-				if err != nil {
-					fmt.Println(err)
-				}
+			if err := rc.Flush(); err != nil {
+				return
 			}
 		}
 	}
@@ -208,33 +327,37 @@ func (app *App) streamHandler(w http.ResponseWriter, r *http.Request) {
 // Metrics
 
 type Point struct {
-	Ts      int64 `json:"ts"`
-	ClicksA int64 `json:"clicksA"`
-	ClicksB int64 `json:"clicksB"`
+	Ts     int64            `json:"ts"`
+	Clicks map[string]int64 `json:"clicks"`
+	ID     int64            `json:"id,omitempty"` // feed event id, see stampPoint; zero in history
+}
+
+func pointID(p Point) int64 {
+	return p.ID
 }
 
 func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := app.db.Query(`SELECT ts, clicksA, clicksB FROM counter_snapshots
-                        		ORDER BY ts`)
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := parseHistoryQuery(r)
 	if err != nil {
-		fmt.Println("Error querying metrics:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	var pts []Point
-	for rows.Next() {
-		var p Point
-		rows.Scan(&p.Ts, &p.ClicksA, &p.ClicksB)
-		pts = append(pts, p)
-	}
-	if err := rows.Err(); err != nil {
-		http.Error(w, "rows error", http.StatusInternalServerError)
+	pts, err := app.db.History(app.slug(), query)
+	if err != nil {
+		fmt.Println("Error querying metrics:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pts)
+	if err := json.NewEncoder(w).Encode(pts); err != nil {
+		fmt.Println("Error encoding metrics:", err)
+	}
 }
 
 func (app *App) metricsFeed(w http.ResponseWriter, r *http.Request) {
@@ -250,25 +373,42 @@ func (app *App) metricsFeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Listen for other points
-	ch := app.broadcaster.Subscribe()
-	defer app.broadcaster.Unsubscribe(ch)
+	app.feedClients.Add(1)
+	defer app.feedClients.Add(-1)
+
+	// Listen for other points, after replaying the ones missed while away
+	sub, missed, resync := app.subscribeFeed(r)
+	defer app.broadcaster.Unsubscribe(sub)
+
+	_ = rc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if resync {
+		if _, err := fmt.Fprint(w, "event:resync\ndata:{}\n\n"); err != nil {
+			return
+		}
+	}
+	for _, point := range missed {
+		if err := writeFeedPoint(w, point); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
 
 	keepAlive := time.NewTicker(30 * time.Second)
 	defer keepAlive.Stop()
 
 	for {
 		select {
-		case point := <-ch:
-			_ = rc.SetWriteDeadline(time.Now().Add(5 * time.Second)) // config ?
-
-			if _, err := fmt.Fprintf(w, "id:%d\nevent:point\ndata:", point.Ts); err != nil {
+		case point, ok := <-sub.C:
+			if !ok {
+				// Fell too far behind; the browser reconnects with
+				// Last-Event-ID and gets the missed points replayed.
 				return
 			}
-			if err := json.NewEncoder(w).Encode(point); err != nil {
-				return
-			}
-			if _, err := fmt.Fprint(w, "\n\n"); err != nil {
+			_ = rc.SetWriteDeadline(time.Now().Add(5 * time.Second)) // config ?
+
+			if err := writeFeedPoint(w, point); err != nil {
 				return
 			}
 
@@ -282,23 +422,55 @@ func (app *App) metricsFeed(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+		case <-app.draining:
+			askFeedToReconnect(w, rc)
+			return
+
 		case <-r.Context().Done():
 			return
 		}
 	}
 }
 
+// subscribeFeed resumes a feed from the last point the client saw: the
+// Last-Event-ID header a reconnecting EventSource sends, or the since
+// parameter of a page that just loaded its history. resync is true when the
+// points in between are gone and the client should refetch /metrics/history.
+func (app *App) subscribeFeed(r *http.Request) (sub *Subscription[Point], missed []Point, resync bool) {
+	lastID, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil {
+		since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			return app.broadcaster.Subscribe(), nil, false
+		}
+		lastID = since*1000 + 999 // since is in seconds, ids in milliseconds
+	}
+	sub, missed, ok := app.broadcaster.SubscribeSince(lastID)
+	return sub, missed, !ok
+}
+
+func writeFeedPoint(w io.Writer, point Point) error {
+	if _, err := fmt.Fprintf(w, "id:%d\nevent:point\ndata:", point.ID); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(point); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w, "\n")
+	return err
+}
+
 ///////////////////////////////////////////////////////////////
 // Server Side Rendered Chart
 
-func (db DB) metricsAsSvg(w http.ResponseWriter, r *http.Request) {
+func (app *App) metricsAsSvg(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "public, max-age=120")
-	points, err := fetchPoints(db)
+	points, err := fetchPoints(app.db, app.slug())
 	if err != nil {
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
-	renderSVG(w, points)
+	renderSVG(w, app.configuration.contest.Options, points)
 }
 
 type ViewPoint struct {
@@ -306,37 +478,51 @@ type ViewPoint struct {
 	views int64
 }
 
-func fetchPoints(db DB) ([]ViewPoint, error) {
-	rows, err := db.Query(`SELECT ts, clicksA, clicksB, views FROM counter_snapshots ORDER BY ts`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var pts []ViewPoint
-	for rows.Next() {
-		var p ViewPoint
-		if err := rows.Scan(&p.Ts, &p.ClicksA, &p.ClicksB, &p.views); err != nil {
-			return nil, err
-		}
-		pts = append(pts, p)
-	}
-	return pts, nil
+// fetchPoints returns every snapshot in time order with the clicks of each
+// option folded into a single point.
+func fetchPoints(db Store, contest string) ([]ViewPoint, error) {
+	return db.History(contest, HistoryQuery{})
 }
 
-func renderSVG(w http.ResponseWriter, pts []ViewPoint) {
+func renderSVG(w http.ResponseWriter, options []Option, pts []ViewPoint) {
 	x := make([]time.Time, len(pts))
-	clicks := make([]float64, len(pts))
-	clicksB := make([]float64, len(pts))
 	views := make([]float64, len(pts))
+	clicks := make([][]float64, len(options))
+	for i := range options {
+		clicks[i] = make([]float64, len(pts))
+	}
 
 	for i, p := range pts {
 		x[i] = time.Unix(p.Ts, 0)
-		clicks[i] = float64(p.ClicksA)
-		clicksB[i] = float64(p.ClicksB)
 		views[i] = float64(p.views)
+		for j, o := range options {
+			clicks[j][i] = float64(p.Clicks[o.ID])
+		}
 	}
 
+	var series []chart.Series
+	for i, o := range options {
+		series = append(series, chart.TimeSeries{
+			Name:    "Clicks " + o.DisplayName(),
+			XValues: x,
+			YValues: clicks[i],
+			Style: chart.Style{
+				Show:        true,
+				StrokeColor: drawing.ColorFromHex(strings.TrimPrefix(o.Color, "#")),
+			},
+		})
+	}
+	series = append(series, chart.TimeSeries{
+		Name:    "Views",
+		XValues: x,
+		YValues: views,
+		Style: chart.Style{
+			Show:        true,
+			StrokeColor: chart.ColorGreen,
+			StrokeWidth: 2.0,
+		},
+	})
+
 	graph := chart.Chart{
 		XAxis: chart.XAxis{
 			Name:           "Time",
@@ -349,32 +535,7 @@ func renderSVG(w http.ResponseWriter, pts []ViewPoint) {
 			NameStyle: chart.StyleShow(),
 			Style:     chart.StyleShow(),
 		},
-		Series: []chart.Series{
-			chart.TimeSeries{
-				Name:    "Clicks A",
-				XValues: x,
-				YValues: clicks,
-			},
-			chart.TimeSeries{
-				Name:    "Clicks B",
-				XValues: x,
-				YValues: clicksB,
-				Style: chart.Style{
-					Show:        true,
-					StrokeColor: chart.ColorRed,
-				},
-			},
-			chart.TimeSeries{
-				Name:    "Views",
-				XValues: x,
-				YValues: views,
-				Style: chart.Style{
-					Show:        true,
-					StrokeColor: chart.ColorGreen,
-					StrokeWidth: 2.0,
-				},
-			},
-		},
+		Series: series,
 	}
 
 	w.Header().Set("Content-Type", "image/svg+xml")
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"strings"
 	"sync/atomic"
 	"testing"
 
@@ -14,38 +15,62 @@ import (
 // ---------------------- helpers ----------------------
 
 func newTestApp() *App {
+	return newTestAppWithOptions(defaultContest.Options)
+}
+
+func newTestAppWithOptions(options []Option) *App {
 	return &App{
-		// db / configuration / broadcaster unused
-		views:   atomic.Int64{},
-		clicksA: atomic.Int64{},
-		clicksB: atomic.Int64{},
+		db:            NewMemoryStore(),
+		counterStream: NewBroadcaster[CounterEvent](SlowConsumerPolicy{mode: policyCoalesce}),
+		configuration: &Configuration{contest: ContestDefinition{Greeting: "hello", Options: options}},
+		Services:      &Services{},
+		views:         atomic.Int64{},
+		clicks:        NewCounters(optionIDs(options)),
+	}
+}
+
+func counterFromSignal(t *testing.T, sig Signal, option string) int64 {
+	t.Helper()
+	counters, ok := sig["counters"].(Signal)
+	if !ok {
+		t.Fatalf("signal lacks counters: %+v", sig)
+	}
+	count, ok := counters[option].(int64)
+	if !ok {
+		t.Fatalf("signal lacks counter %q: %+v", option, sig)
 	}
+	return count
 }
 
-// ---------------------- ClickA / ClickB ----------------------
+// ---------------------- Click ----------------------
 
 func TestClickFunctionsIncrementAndReturnSignal(t *testing.T) {
 	app := newTestApp()
 
-	// First ClickA
-	sigA1 := app.ClickA()
-	if want := int64(1); sigA1["counterA"].(int64) != want || app.clicksA.Load() != want {
-		t.Fatalf("ClickA first call: want count %d, got %+v / stored %d",
-			want, sigA1["counterA"], app.clicksA.Load())
+	// First click on A
+	sigA1, _, _ := app.Click("A", "client")
+	if want := int64(1); counterFromSignal(t, sigA1, "A") != want || app.clicks.Load("A") != want {
+		t.Fatalf("Click(A) first call: want count %d, got %+v / stored %d",
+			want, sigA1, app.clicks.Load("A"))
+	}
+
+	// Second click on A
+	sigA2, _, _ := app.Click("A", "client")
+	if want := int64(2); counterFromSignal(t, sigA2, "A") != want || app.clicks.Load("A") != want {
+		t.Fatalf("Click(A) second call: want count %d, got %+v / stored %d",
+			want, sigA2, app.clicks.Load("A"))
 	}
 
-	// Second ClickA
-	sigA2 := app.ClickA()
-	if want := int64(2); sigA2["counterA"].(int64) != want || app.clicksA.Load() != want {
-		t.Fatalf("ClickA second call: want count %d, got %+v / stored %d",
-			want, sigA2["counterA"], app.clicksA.Load())
+	// Click on B once
+	sigB, _, _ := app.Click("B", "client")
+	if want := int64(1); counterFromSignal(t, sigB, "B") != want || app.clicks.Load("B") != want {
+		t.Fatalf("Click(B) first call: want count %d, got %+v / stored %d",
+			want, sigB, app.clicks.Load("B"))
 	}
 
-	// ClickB once
-	sigB := app.ClickB()
-	if want := int64(1); sigB["counterB"].(int64) != want || app.clicksB.Load() != want {
-		t.Fatalf("ClickB first call: want count %d, got %+v / stored %d",
-			want, sigB["counterB"], app.clicksB.Load())
+	// Unknown option
+	if _, _, ok := app.Click("Z", "client"); ok {
+		t.Fatal("Click(Z) should report unknown option")
 	}
 }
 
@@ -54,11 +79,11 @@ func TestClickFunctionsIncrementAndReturnSignal(t *testing.T) {
 func TestHomeHandlerRendersJSON(t *testing.T) {
 	// Arrange
 	app := newTestApp()
-	greeting = "hello, world" // Todo: remove global
+	app.configuration.contest.Greeting = "hello, world"
 
 	app.views.Store(42)
-	app.clicksA.Store(2)
-	app.clicksB.Store(0)
+	app.clicks.Store("A", 2)
+	app.clicks.Store("B", 0)
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	rr := httptest.NewRecorder()
@@ -71,8 +96,30 @@ func TestHomeHandlerRendersJSON(t *testing.T) {
 		t.Fatalf("homeHandler: want HTTP 200, got %d", rr.Code)
 	}
 
-	// verify HTML
-	doc, err := html.Parse(rr.Body)
+	page := rr.Body.String()
+	sig := pageSignals(t, page)
+
+	// buttons come from the contest definition
+	if !strings.Contains(page, "🐕 (Dog)") || !strings.Contains(page, "#ff7fa3") {
+		t.Error("home page lacks configured button label or color")
+	}
+
+	// check signals are sent correctly
+	if sig.Message != "hello, world" || sig.Counters["A"] != 2 || sig.Counters["B"] != 0 || sig.ShowModal != false {
+		t.Errorf("unexpected signals: %+v", sig)
+	}
+
+	// views should have incremented
+	if want := int64(43); app.views.Load() != want {
+		t.Errorf("homeHandler did not bump views counter: want %d, got %d", want, app.views.Load())
+	}
+}
+
+// pageSignals parses a rendered page and decodes the data-signals of its
+// body, failing when the attribute was cut short or has company.
+func pageSignals(t *testing.T, page string) HomePageSignals {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(page))
 	if err != nil {
 		t.Fatalf("response is not valid HTML: %v", err)
 	}
@@ -86,9 +133,12 @@ func TestHomeHandlerRendersJSON(t *testing.T) {
 
 	var signalsAttr string
 	for _, a := range body.Attr {
-		if a.Key == "data-signals" {
+		switch a.Key {
+		case "data-signals":
 			signalsAttr = a.Val
-			break
+		case "data-on-load":
+		default:
+			t.Fatalf("unexpected body attribute %q", a.Key)
 		}
 	}
 	if signalsAttr == "" {
@@ -99,16 +149,7 @@ func TestHomeHandlerRendersJSON(t *testing.T) {
 	if err := json.Unmarshal([]byte(signalsAttr), &sig); err != nil {
 		t.Fatalf("data-signals is not valid JSON: %v\nvalue: %q", err, signalsAttr)
 	}
-
-	// check signals are sent correctly
-	if sig.Message != greeting || sig.CounterA != 2 || sig.CounterB != 0 || sig.ShowModal != false {
-		t.Errorf("unexpected signals: %+v", sig)
-	}
-
-	// views should have incremented
-	if want := int64(43); app.views.Load() != want {
-		t.Errorf("homeHandler did not bump views counter: want %d, got %d", want, app.views.Load())
-	}
+	return sig
 }
 
 func find(n *html.Node, pred func(*html.Node) bool) *html.Node {
@@ -154,9 +195,71 @@ func TestClickHandlerRoutingAndValidation(t *testing.T) {
 			t.Fatalf("case %d (%s %s): want HTTP %d, got %d",
 				i, tc.method, path.Base(tc.url), tc.wantCode, rr.Code)
 		}
-		if app.clicksA.Load() != tc.wantA || app.clicksB.Load() != tc.wantB {
+		if app.clicks.Load("A") != tc.wantA || app.clicks.Load("B") != tc.wantB {
 			t.Fatalf("case %d (%s): counters wrong – want A=%d,B=%d got A=%d,B=%d",
-				i, path.Base(tc.url), tc.wantA, tc.wantB, app.clicksA.Load(), app.clicksB.Load())
+				i, path.Base(tc.url), tc.wantA, tc.wantB, app.clicks.Load("A"), app.clicks.Load("B"))
 		}
 	}
 }
+
+func TestClickHandlerConfiguredOptions(t *testing.T) {
+	app := newTestAppWithOptions([]Option{{ID: "A"}, {ID: "B"}, {ID: "C"}, {ID: "Fish"}})
+
+	for _, option := range []string{"C", "Fish", "Fish"} {
+		req := httptest.NewRequest(http.MethodPost, "/click/"+option, nil)
+		rr := httptest.NewRecorder()
+		app.clickHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("click %s: want HTTP 200, got %d", option, rr.Code)
+		}
+	}
+
+	want := map[string]int64{"A": 0, "B": 0, "C": 1, "Fish": 2}
+	if got := app.clicks.Snapshot(); !sameCounts(got, want) {
+		t.Fatalf("counters: want %v, got %v", want, got)
+	}
+}
+
+// ---------------------- metrics ----------------------
+
+func TestMetricsHandlerReadsStore(t *testing.T) {
+	app := newTestApp()
+	app.db.InsertSnapshot("", 100, map[string]int64{"A": 1, "B": 0}, 3)
+	app.db.InsertSnapshot("", 200, map[string]int64{"A": 4, "B": 2}, 7)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics/history", nil)
+	rr := httptest.NewRecorder()
+	app.metricsHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("metricsHandler: want HTTP 200, got %d", rr.Code)
+	}
+	var pts []Point
+	if err := json.Unmarshal(rr.Body.Bytes(), &pts); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(pts) != 2 || pts[1].Ts != 200 || pts[1].Clicks["A"] != 4 || pts[1].Clicks["B"] != 2 {
+		t.Fatalf("unexpected points: %+v", pts)
+	}
+}
+
+func TestMetricsAsSvgRendersChart(t *testing.T) {
+	app := newTestApp()
+	for ts := int64(100); ts < 160; ts += 10 {
+		app.db.InsertSnapshot("", ts, map[string]int64{"A": ts, "B": ts / 2}, ts)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics.svg", nil)
+	rr := httptest.NewRecorder()
+	app.metricsAsSvg(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("metricsAsSvg: want HTTP 200, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("content type: want image/svg+xml, got %q", ct)
+	}
+	if body := rr.Body.String(); !strings.HasPrefix(strings.TrimSpace(body), "<svg") {
+		t.Fatalf("body is not an svg: %.80q", body)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"time"
+
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+// Clients are told to come back after a random delay in this range so a
+// deploy doesn't get every browser reconnecting in the same instant.
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 5 * time.Second
+)
+
+// drain is the first step of shutting down: clicks are refused from here on
+// and every open /stream and /metrics/feed is asked to reconnect, so the
+// http server is left with only short requests to wait for.
+func (s *Services) drain() {
+	close(s.draining)
+}
+
+// isDraining reports whether the server is shutting down. Services without a
+// draining channel never drain.
+func (s *Services) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func reconnectDelay() time.Duration {
+	return reconnectMinDelay + rand.N(reconnectMaxDelay-reconnectMinDelay)
+}
+
+// rejectDraining answers clicks that arrive during shutdown.
+func rejectDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "server is restarting, try again in a moment", http.StatusServiceUnavailable)
+}
+
+// askStreamToReconnect tells a datastar client to open url again once the
+// replacement server is likely up. Only the stream is reopened; the page
+// stays, so this doesn't count as another view.
+func askStreamToReconnect(sse *datastar.ServerSentEventGenerator, url string) {
+	fragment := fmt.Sprintf(`<div data-on-load__delay.%dms="@get('%s')"></div>`, reconnectDelay().Milliseconds(), url)
+	if err := sse.MergeFragments(fragment, datastar.WithSelector("body"), datastar.WithMergeAppend()); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// askFeedToReconnect sets the EventSource retry delay before the server closes
+// /metrics/feed, so the browser reconnects on its own and catches up through
+// /metrics/history.
+func askFeedToReconnect(w http.ResponseWriter, rc *http.ResponseController) {
+	_ = rc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(w, "retry:%d\nevent:reconnect\ndata:{}\n\n", reconnectDelay().Milliseconds())
+	_ = rc.Flush()
+}
+
+// shutdown stops the server in an order that loses no clicks: drain, wait for
+// in flight requests on the public server, stop the background jobs, write a
+// final snapshot of every contest and flush the click log. The internal and
+// metrics servers go last, just before the database closes, so /readyz keeps
+// reporting the drain and the final counts can still be scraped.
+func shutdown(server, internal, metrics *http.Server, app *App, contests *Contests, timeout time.Duration) {
+	log.Println("shutting down")
+	app.drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stopServer(ctx, server, "http server")
+
+	app.close()
+	if err := app.finalSnapshot(time.Now()); err != nil {
+		log.Println("Error taking final snapshot:", err)
+	}
+	contests.closeAll()
+	app.clickLog.Close()
+
+	stopServer(ctx, internal, "internal server")
+	stopServer(ctx, metrics, "metrics server")
+	if err := app.db.Close(); err != nil {
+		log.Println("Error closing database:", err)
+	}
+	if err := os.Remove(serverMarkerPath(app.configuration.dbPath())); err != nil && !os.IsNotExist(err) {
+		log.Println("Error removing server marker:", err)
+	}
+	log.Println("shutdown complete")
+}
+
+// stopServer waits for the requests in flight on server, which is nil when
+// it isn't configured.
+func stopServer(ctx context.Context, server *http.Server, name string) {
+	if server == nil {
+		return
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down "+name+":", err)
+	}
+}
+
+// finalSnapshot saves the counters unless the latest snapshot already has
+// them. It must run after close, so it can't race the periodic snapshot for
+// the same second.
+func (app *App) finalSnapshot(now time.Time) error {
+	latest, found, err := app.db.LatestSnapshot(app.slug())
+	if err != nil {
+		return err
+	}
+	replica := app.clicks.ReplicaState()
+	clicks := app.clicks.Snapshot()
+	views := app.views.Load()
+	if found && sameCounts(clicks, latest.Clicks) && views == latest.views {
+		app.saveReplica(replica)
+		return nil
+	}
+	ts := max(now.UTC().Unix(), latest.Ts+1)
+	if err := app.db.InsertSnapshot(app.slug(), ts, clicks, views); err != nil {
+		return err
+	}
+	app.saveReplica(replica)
+	return nil
+}
+
+// closeAll stops the expiry sweep and every user contest, and saves their
+// counters and activity.
+func (contests *Contests) closeAll() {
+	close(contests.done)
+	contests.workers.Wait()
+
+	contests.Lock()
+	entries := contests.bySlug
+	contests.bySlug = make(map[string]*contestEntry)
+	contests.Unlock()
+
+	for slug, entry := range entries {
+		entry.app.close()
+		if err := entry.app.finalSnapshot(time.Now()); err != nil {
+			log.Println("Error taking final snapshot of contest", slug+":", err)
+		}
+		if err := contests.db.UpdateContestActivity(slug, entry.app.lastActive.Load()); err != nil {
+			log.Println("Error saving contest activity:", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDrainableApp(t *testing.T) *App {
+	t.Helper()
+	app := newTestApp()
+	app.db = newTestDB(t)
+	app.broadcaster = NewBroadcaster[Point](SlowConsumerPolicy{})
+	app.draining = make(chan struct{})
+	return app
+}
+
+// serveUntilDrained runs a streaming handler and drains the app once the
+// handler is connected.
+func serveUntilDrained(t *testing.T, app *App, handler http.HandlerFunc, connected func() bool) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		handler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(finished)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("handler never connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	app.drain()
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler kept streaming after drain")
+	}
+	return rr.Body.String()
+}
+
+func TestDrainRejectsClicks(t *testing.T) {
+	app := newDrainableApp(t)
+	app.drain()
+
+	rr := httptest.NewRecorder()
+	app.clickHandler(rr, httptest.NewRequest(http.MethodPost, "/click/A", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("want 503 with Retry-After, got %d %v", rr.Code, rr.Header())
+	}
+	if got := app.clicks.Load("A"); got != 0 {
+		t.Fatalf("click counted while draining: %d", got)
+	}
+}
+
+func TestDrainAsksStreamsToReconnect(t *testing.T) {
+	app := newDrainableApp(t)
+	body := serveUntilDrained(t, app, app.streamHandler, func() bool { return app.streamClients.Load() == 1 })
+	if !strings.Contains(body, "@get('stream')") || strings.Contains(body, "location.reload()") {
+		t.Fatalf("stream should be told to reconnect, got %q", body)
+	}
+}
+
+func TestDrainAsksFeedsToReconnect(t *testing.T) {
+	app := newDrainableApp(t)
+	body := serveUntilDrained(t, app, app.metricsFeed, func() bool { return app.feedClients.Load() == 1 })
+	if !strings.Contains(body, "event:reconnect") || !strings.Contains(body, "retry:") {
+		t.Fatalf("feed should be told to reconnect, got %q", body)
+	}
+}
+
+func TestFinalSnapshotSavesOnlyChanges(t *testing.T) {
+	app := newDrainableApp(t)
+	now := time.Unix(1_700_000_000, 0)
+
+	app.clicks.Add("A", 3)
+	if err := app.finalSnapshot(now); err != nil {
+		t.Fatalf("final snapshot: %v", err)
+	}
+	// Nothing changed, and a second write in the same second must not fail.
+	if err := app.finalSnapshot(now); err != nil {
+		t.Fatalf("unchanged final snapshot: %v", err)
+	}
+	app.clicks.Add("B", 1)
+	if err := app.finalSnapshot(now); err != nil {
+		t.Fatalf("final snapshot in the same second: %v", err)
+	}
+
+	if pts, _ := fetchPoints(app.db, ""); len(pts) != 2 {
+		t.Fatalf("snapshots: want 2, got %d", len(pts))
+	}
+	clicks, _ := fetchMostRecentSnapshot(app.db, "")
+	if clicks["A"] != 3 || clicks["B"] != 1 {
+		t.Fatalf("latest snapshot: got %v", clicks)
+	}
+}
+
+func TestCloseWaitsForBackgroundJobs(t *testing.T) {
+	app := newDrainableApp(t)
+	app.done = make(chan struct{})
+	app.configuration.snapshotInterval = time.Millisecond
+	app.configuration.broadcastInterval = time.Millisecond
+	app.takePeriodicSnapshots()
+	app.sendPeriodicBroadcasts()
+
+	app.clicks.Add("A", 1)
+	time.Sleep(20 * time.Millisecond)
+	app.close()
+
+	// With the jobs stopped the final snapshot is the last write.
+	app.clicks.Add("A", 1)
+	if err := app.finalSnapshot(time.Now()); err != nil {
+		t.Fatalf("final snapshot: %v", err)
+	}
+	clicks, _ := fetchMostRecentSnapshot(app.db, "")
+	if clicks["A"] != 2 {
+		t.Fatalf("latest snapshot: got %v", clicks)
+	}
+}
+
+func TestCloseAllStopsExpirySweep(t *testing.T) {
+	contests := newTestContests(t, ContestLimits{idleTTL: time.Hour})
+	contests.expireIdleContests()
+
+	closed := make(chan struct{})
+	go func() {
+		contests.closeAll()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("closeAll should stop the sweep before closing the contests")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// The page templates and static assets are embedded, so the binary runs from
+// any directory. SITE_DIR serves them from a directory laid out the same way
+// instead (usually this one), re-reading them on every request so edits
+// show up without a rebuild.
+//
+//go:generate sh vendor.sh
+//go:embed templates/*.tmpl.html assets
+var siteFiles embed.FS
+
+// Site renders the pages and serves /assets/. Asset urls carry a hash of the
+// file, ?v=<hash>, so browsers can cache them until they change.
+type Site struct {
+	files  fs.FS
+	dev    bool
+	tmpl   *template.Template // parsed once unless dev
+	mu     sync.Mutex
+	hashes map[string]string // asset name -> hash, unless dev
+	warned map[string]bool   // vendored files reported missing
+}
+
+var site = mustSite(siteFiles, false)
+
+func mustSite(files fs.FS, dev bool) *Site {
+	s := &Site{files: files, dev: dev, hashes: make(map[string]string), warned: make(map[string]bool)}
+	if !dev {
+		s.tmpl = template.Must(s.parse())
+	}
+	return s
+}
+
+// useSiteDir switches to the templates and assets under dir.
+func useSiteDir(dir string) {
+	site = mustSite(os.DirFS(dir), true)
+	log.Println("serving templates and assets from", dir)
+}
+
+func (s *Site) parse() (*template.Template, error) {
+	funcs := template.FuncMap{"asset": s.assetURL, "vendor": s.vendorURL}
+	return template.New("").Funcs(funcs).ParseFS(s.files, "templates/*.tmpl.html")
+}
+
+func (s *Site) render(w io.Writer, name string, data any) error {
+	tmpl := s.tmpl
+	if s.dev {
+		var err error
+		if tmpl, err = s.parse(); err != nil {
+			return err
+		}
+	}
+	return tmpl.ExecuteTemplate(w, name, data)
+}
+
+// assetURL is the cache-busting url of an asset, e.g. "metrics.js".
+func (s *Site) assetURL(name string) string {
+	hash, ok := s.hash(name)
+	if !ok {
+		return "/assets/" + name
+	}
+	return "/assets/" + name + "?v=" + hash
+}
+
+// vendorURL serves a front-end library from assets/vendor, where vendor.sh
+// puts it. A build without it falls back to the CDN and says so once.
+func (s *Site) vendorURL(name, cdn string) string {
+	if _, ok := s.hash(path.Join("vendor", name)); !ok {
+		s.mu.Lock()
+		if !s.warned[name] && !s.dev {
+			log.Printf("assets/vendor/%s is missing, loading it from %s; run go generate to vendor it\n", name, cdn)
+		}
+		s.warned[name] = true
+		s.mu.Unlock()
+		return cdn
+	}
+	return s.assetURL(path.Join("vendor", name))
+}
+
+// hash returns a short hash of an asset's content, or false when there is no
+// such asset.
+func (s *Site) hash(name string) (string, bool) {
+	if !s.dev {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if hash, ok := s.hashes[name]; ok {
+			return hash, hash != ""
+		}
+	}
+	hash := ""
+	if raw, err := fs.ReadFile(s.files, path.Join("assets", name)); err == nil {
+		sum := sha256.Sum256(raw)
+		hash = hex.EncodeToString(sum[:6])
+	}
+	if !s.dev {
+		s.hashes[name] = hash
+	}
+	return hash, hash != ""
+}
+
+// assetHandler serves /assets/. A request for the current version of a file
+// may be cached for good; anything else has to be revalidated.
+func (s *Site) assetHandler() http.Handler {
+	assets, _ := fs.Sub(s.files, "assets")
+	files := http.StripPrefix("/assets/", http.FileServerFS(assets))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash, ok := s.hash(path.Clean(r.URL.Path[len("/assets/"):]))
+		if v := r.URL.Query().Get("v"); ok && v == hash {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testSiteFiles() fstest.MapFS {
+	return fstest.MapFS{
+		"templates/page.tmpl.html": {Data: []byte(`{{define "page"}}{{asset "app.js"}} {{vendor "lib-1.0.js" "https://cdn.example/lib.js"}} {{vendor "gone.js" "https://cdn.example/gone.js"}}{{end}}`)},
+		"assets/app.js":            {Data: []byte("console.log(1)")},
+		"assets/vendor/lib-1.0.js": {Data: []byte("lib")},
+	}
+}
+
+func TestSiteVersionsAssetURLs(t *testing.T) {
+	s := mustSite(testSiteFiles(), false)
+	var out bytes.Buffer
+	if err := s.render(&out, "page", nil); err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "/assets/app.js?v=") ||
+		!strings.HasPrefix(fields[1], "/assets/vendor/lib-1.0.js?v=") || fields[2] != "https://cdn.example/gone.js" {
+		t.Fatalf("want hashed local urls and a cdn fallback, got %q", out.String())
+	}
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		s.assetHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr
+	}
+	if rr := serve(fields[0]); rr.Code != http.StatusOK || rr.Body.String() != "console.log(1)" ||
+		!strings.Contains(rr.Header().Get("Cache-Control"), "immutable") {
+		t.Fatalf("current version: %d %q %q", rr.Code, rr.Body.String(), rr.Header().Get("Cache-Control"))
+	}
+	if rr := serve("/assets/app.js?v=stale"); rr.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("stale version should be revalidated, got %q", rr.Header().Get("Cache-Control"))
+	}
+}
+
+func TestDevSiteRereadsFiles(t *testing.T) {
+	files := testSiteFiles()
+	s := mustSite(files, true)
+	before := s.assetURL("app.js")
+	files["assets/app.js"] = &fstest.MapFile{Data: []byte("console.log(2)")}
+	files["templates/page.tmpl.html"] = &fstest.MapFile{Data: []byte(`{{define "page"}}edited{{end}}`)}
+
+	if after := s.assetURL("app.js"); after == before {
+		t.Fatal("changed asset should get a new url")
+	}
+	var out bytes.Buffer
+	if err := s.render(&out, "page", nil); err != nil || out.String() != "edited" {
+		t.Fatalf("want the edited template, got %q, err %v", out.String(), err)
+	}
+}
+
+func TestEmbeddedSiteRendersHome(t *testing.T) {
+	var out bytes.Buffer
+	if err := site.render(&out, "home", HomePageData{Signals: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `src="/assets/metrics.js?v=`) {
+		t.Fatalf("home should link hashed assets, got %s", out.String())
+	}
+}
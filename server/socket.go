@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// /ws carries clicks up and updates down on one connection, for clients that
+// click too much to pay for a POST each time. Every frame is a JSON
+// SocketMessage.
+//
+//	client: {"type":"click","option":"A"}
+//	server: {"type":"signals","signals":{...}}   the same signal patches /click and /stream send
+//	        {"type":"point","point":{...}}       a /metrics/feed point
+//	        {"type":"resync"}                    refetch /metrics/history, points were missed
+//	        {"type":"milestone",...}             the click was notable, claim it with the token
+//	        {"type":"error","error":"..."}
+//	        {"type":"reconnect","retryAfter":ms} the server is going away
+//
+// Like /metrics/feed, ?since=<ts> replays the points after the last one the
+// client has.
+type SocketMessage struct {
+	Type        string     `json:"type"`
+	Option      string     `json:"option,omitempty"`
+	Signals     Signal     `json:"signals,omitempty"`
+	Point       *Point     `json:"point,omitempty"`
+	Milestone   *Milestone `json:"milestone,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Token       string     `json:"token,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	RetryAfter  int64      `json:"retryAfter,omitempty"` // milliseconds
+}
+
+const (
+	socketMaxMessage   = 1024
+	socketWriteTimeout = 5 * time.Second
+)
+
+func encodeSocketMessage(m SocketMessage) []byte {
+	b, _ := json.Marshal(m)
+	return b
+}
+
+func (app *App) socketHandler() http.Handler {
+	return websocket.Server{Handshake: sameOriginSocket, Handler: app.serveSocket}
+}
+
+// sameOriginSocket refuses browser connections opened by other sites, which
+// could otherwise click on their visitors' behalf. Clients that send no
+// Origin are let through, as they could just as well POST /click.
+func sameOriginSocket(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != r.Host {
+		return errors.New("cross origin websocket")
+	}
+	config.Origin = u
+	return nil
+}
+
+func (app *App) serveSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = socketMaxMessage
+	r := ws.Request()
+	ip := app.configuration.clientIP(r)
+	app.touch()
+	app.socketClients.Add(1)
+	defer app.socketClients.Add(-1)
+
+	counters := app.counterStream.Subscribe()
+	defer app.counterStream.Unsubscribe(counters)
+	points, missed, resync := app.subscribeFeed(r)
+	defer app.broadcaster.Unsubscribe(points)
+
+	send := func(m SocketMessage) error {
+		return sendSocket(ws, encodeSocketMessage(m))
+	}
+	if err := send(SocketMessage{Type: "signals", Signals: app.liveSignals(app.clicks.Snapshot())}); err != nil {
+		return
+	}
+	if resync {
+		if err := send(SocketMessage{Type: "resync"}); err != nil {
+			return
+		}
+	}
+	for _, p := range missed {
+		if err := send(SocketMessage{Type: "point", Point: &p}); err != nil {
+			return
+		}
+	}
+
+	clicks := make(chan string)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(clicks)
+		for {
+			var m SocketMessage
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				return
+			}
+			if m.Type != "click" {
+				continue
+			}
+			select {
+			case clicks <- m.Option:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		var err error
+		select {
+		case option, ok := <-clicks:
+			if !ok {
+				return
+			}
+			err = app.socketClick(ws, ip, option)
+		case event, ok := <-counters.C:
+			if !ok {
+				send(SocketMessage{Type: "reconnect", RetryAfter: reconnectDelay().Milliseconds()})
+				return
+			}
+			err = sendSocket(ws, event.ws)
+		case point, ok := <-points.C:
+			if !ok {
+				send(SocketMessage{Type: "reconnect", RetryAfter: reconnectDelay().Milliseconds()})
+				return
+			}
+			err = send(SocketMessage{Type: "point", Point: &point})
+		case <-app.draining:
+			send(SocketMessage{Type: "reconnect", RetryAfter: reconnectDelay().Milliseconds()})
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// socketClick answers a click the way clickHandler does, with messages
+// instead of status codes.
+func (app *App) socketClick(ws *websocket.Conn, ip, option string) error {
+	signal, milestone, client, err := app.clickFrom(ip, option)
+	var reply SocketMessage
+	switch err {
+	case nil:
+		signal["notice"] = ""
+		reply = SocketMessage{Type: "signals", Signals: signal}
+	case errDraining:
+		reply = SocketMessage{Type: "reconnect", RetryAfter: reconnectDelay().Milliseconds()}
+	case errPaused:
+		reply = SocketMessage{Type: "signals", Signals: Signal{"notice": pausedNotice}}
+	case errRateLimited:
+		reply = SocketMessage{Type: "signals", Signals: Signal{"notice": slowDownNotice}, RetryAfter: app.limiter.RetryAfter().Milliseconds()}
+	default:
+		reply = SocketMessage{Type: "error", Option: option, Error: err.Error()}
+	}
+	if err := sendSocket(ws, encodeSocketMessage(reply)); err != nil {
+		return err
+	}
+	if err == errDraining {
+		return err
+	}
+	if milestone != nil {
+		token, err := app.milestoneTokens.Issue(*milestone, client)
+		if err != nil {
+			log.Println("ws error issuing milestone token:", err)
+			return nil
+		}
+		return sendSocket(ws, encodeSocketMessage(SocketMessage{
+			Type:        "milestone",
+			Milestone:   milestone,
+			Description: app.describeMilestone(*milestone),
+			Token:       token,
+		}))
+	}
+	return nil
+}
+
+func sendSocket(ws *websocket.Conn, msg []byte) error {
+	_ = ws.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	return websocket.Message.Send(ws, string(msg))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialSocket serves app's /ws and connects to it.
+func dialSocket(t *testing.T, app *App, query string) *websocket.Conn {
+	t.Helper()
+	if app.broadcaster == nil {
+		app.broadcaster = newPointBroadcaster(10)
+	}
+	srv := httptest.NewServer(app.socketHandler())
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	ws, err := websocket.Dial("ws://"+host+"/ws"+query, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func receive(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func click(t *testing.T, ws *websocket.Conn, option string) {
+	t.Helper()
+	if err := websocket.JSON.Send(ws, SocketMessage{Type: "click", Option: option}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketClicks(t *testing.T) {
+	app := newTestApp()
+	app.clicks.Store("B", 4)
+	ws := dialSocket(t, app, "")
+
+	if got := receive(t, ws); got != `{"type":"signals","signals":{"counters":{"A":0,"B":4}}}` {
+		t.Fatalf("want the current counts first, got %s", got)
+	}
+	click(t, ws, "A")
+	if got := receive(t, ws); got != `{"type":"signals","signals":{"counters":{"A":1},"notice":""}}` {
+		t.Fatalf("want the click counted, got %s", got)
+	}
+	click(t, ws, "Z")
+	if got := receive(t, ws); !strings.Contains(got, `"type":"error"`) || app.clicks.Has("Z") {
+		t.Fatalf("want unknown options refused, got %s", got)
+	}
+}
+
+func TestSocketRateLimitsClicks(t *testing.T) {
+	app := newTestApp()
+	app.limiter = NewRateLimiter(1, 1)
+	ws := dialSocket(t, app, "")
+	receive(t, ws)
+
+	click(t, ws, "A")
+	receive(t, ws)
+	click(t, ws, "A")
+	if got := receive(t, ws); !strings.Contains(got, slowDownNotice) || !strings.Contains(got, `"retryAfter":`) {
+		t.Fatalf("want a slow down notice, got %s", got)
+	}
+	if count := app.clicks.Snapshot()["A"]; count != 1 {
+		t.Fatalf("want 1 click counted, got %d", count)
+	}
+}
+
+func TestSocketForwardsUpdates(t *testing.T) {
+	app := newTestApp()
+	app.broadcaster = newPointBroadcaster(10)
+	app.broadcaster.Publish(Point{Ts: 100, ID: 100000})
+	app.broadcaster.Publish(Point{Ts: 200, ID: 200000})
+	ws := dialSocket(t, app, "?since=100")
+	receive(t, ws)
+	if got := receive(t, ws); !strings.Contains(got, `"point":{"ts":200`) {
+		t.Fatalf("want point 200 replayed, got %s", got)
+	}
+
+	app.clicks.Add("B", 2)
+	app.publishCounters(nil)
+	if got := receive(t, ws); got != `{"type":"signals","signals":{"counters":{"A":0,"B":2}}}` {
+		t.Fatalf("want published counters forwarded, got %s", got)
+	}
+	app.broadcaster.Publish(Point{Ts: 300, ID: 300000})
+	if got := receive(t, ws); !strings.Contains(got, `"point":{"ts":300`) {
+		t.Fatalf("want new points forwarded, got %s", got)
+	}
+}
+
+func TestSocketAsksToReconnectWhenDraining(t *testing.T) {
+	app := newTestApp()
+	app.draining = make(chan struct{})
+	ws := dialSocket(t, app, "")
+	receive(t, ws)
+
+	app.drain()
+	if got := receive(t, ws); !strings.Contains(got, `"type":"reconnect"`) {
+		t.Fatalf("want a reconnect message, got %s", got)
+	}
+}
+
+func TestSocketRefusesOtherOrigins(t *testing.T) {
+	srv := httptest.NewServer(newTestApp().socketHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if _, err := websocket.Dial("ws://"+host+"/ws", "", "https://elsewhere.example"); err == nil {
+		t.Fatal("cross origin connection should be refused")
+	}
+	if resp, err := http.Get(srv.URL); err == nil && resp.StatusCode == http.StatusOK {
+		t.Fatal("plain requests should not be upgraded")
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS snapshot_clicks;
+DROP TABLE IF EXISTS counter_snapshots;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS counter_snapshots (
+    contest TEXT    NOT NULL DEFAULT '',
+    ts      INTEGER NOT NULL,
+    views   INTEGER NOT NULL,
+    PRIMARY KEY (contest, ts)
+);
+
+CREATE TABLE IF NOT EXISTS snapshot_clicks (
+    contest TEXT    NOT NULL DEFAULT '',
+    ts      INTEGER NOT NULL,
+    option  TEXT    NOT NULL,
+    clicks  INTEGER NOT NULL,
+    PRIMARY KEY (contest, ts, option)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS contests_creator;
+DROP TABLE IF EXISTS contests;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS contests (
+    slug        TEXT    PRIMARY KEY,
+    title       TEXT    NOT NULL,
+    options     TEXT    NOT NULL,
+    creator     TEXT    NOT NULL,
+    created_at  INTEGER NOT NULL,
+    last_active INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS contests_creator ON contests(creator, created_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS click_events_contest_ts;
+DROP TABLE IF EXISTS click_events;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS click_events (
+    id      INTEGER PRIMARY KEY,
+    ts      INTEGER NOT NULL, -- unix milliseconds
+    contest TEXT    NOT NULL DEFAULT '',
+    option  TEXT    NOT NULL,
+    client  TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS click_events_contest_ts ON click_events(contest, ts);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS rollup_clicks_contest_ts;
+DROP INDEX IF EXISTS rollup_snapshots_contest_ts;
+DROP TABLE IF EXISTS rollup_clicks;
+DROP TABLE IF EXISTS rollup_snapshots;
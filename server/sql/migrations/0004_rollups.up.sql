@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS rollup_snapshots (
+    tier    TEXT    NOT NULL, -- minute, hour or day
+    contest TEXT    NOT NULL DEFAULT '',
+    ts      INTEGER NOT NULL,
+    views   INTEGER NOT NULL,
+    PRIMARY KEY (tier, contest, ts)
+);
+
+CREATE TABLE IF NOT EXISTS rollup_clicks (
+    tier    TEXT    NOT NULL,
+    contest TEXT    NOT NULL DEFAULT '',
+    ts      INTEGER NOT NULL,
+    option  TEXT    NOT NULL,
+    clicks  INTEGER NOT NULL,
+    PRIMARY KEY (tier, contest, ts, option)
+);
+
+CREATE INDEX IF NOT EXISTS rollup_snapshots_contest_ts ON rollup_snapshots(contest, ts);
+CREATE INDEX IF NOT EXISTS rollup_clicks_contest_ts ON rollup_clicks(contest, ts);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS milestones (
+    contest TEXT    NOT NULL DEFAULT '',
+    option  TEXT    NOT NULL,
+    count   INTEGER NOT NULL,
+    kind    TEXT    NOT NULL, -- count or lead
+    name    TEXT    NOT NULL,
+    client  TEXT    NOT NULL, -- anonymized client that made the click
+    ts      INTEGER NOT NULL,
+    PRIMARY KEY (contest, option, count, kind)
+);
@@ -0,0 +1,8 @@
+-- Per node click counts of a replicated contest, see replication.go.
+CREATE TABLE IF NOT EXISTS replica_counts (
+    contest TEXT    NOT NULL DEFAULT '',
+    node    TEXT    NOT NULL,
+    option  TEXT    NOT NULL,
+    clicks  INTEGER NOT NULL,
+    PRIMARY KEY (contest, node, option)
+);
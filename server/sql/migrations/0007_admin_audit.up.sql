@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS admin_audit (
+    id     INTEGER PRIMARY KEY,
+    ts     INTEGER NOT NULL, -- unix seconds
+    action TEXT    NOT NULL,
+    detail TEXT    NOT NULL,
+    client TEXT    NOT NULL  -- anonymized client of the admin
+);
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"time"
+)
+
+// Store is everything the app keeps across restarts: snapshots and the history
+// built from them, the click log, contests, milestones and backups. DB is the
+// SQLite implementation the server runs on; MemoryStore keeps the same data in
+// maps so handlers can be exercised without touching disk.
+type Store interface {
+	// LatestSnapshot returns the newest snapshot of a contest, or false when
+	// it has none yet.
+	LatestSnapshot(contest string) (ViewPoint, bool, error)
+	InsertSnapshot(contest string, ts int64, clicks map[string]int64, views int64) error
+	History(contest string, q HistoryQuery) ([]ViewPoint, error)
+	Compact(config CompactionConfig, now time.Time) (int64, error)
+
+	InsertClickEvents(events []ClickEvent) error
+	ClicksSinceSnapshot(contest string) (map[string]int64, error)
+
+	InsertContest(contest *Contest) error
+	Contests() ([]storedContest, error)
+	CountContestsBy(creator string, since int64) (int, error)
+	UpdateContestActivity(slug string, lastActive int64) error
+	DeleteContest(slug string) error
+
+	InsertMilestone(m Milestone, name, client string) error
+	Milestones(contest string, limit int) ([]RecordedMilestone, error)
+
+	// ReplicaCounts returns the per node counts saved for a contest, empty
+	// when it was never replicated. SaveReplicaCounts never lowers a count.
+	ReplicaCounts(contest string) (ReplicaState, error)
+	SaveReplicaCounts(contest string, state ReplicaState) error
+
+	InsertAudit(entry AuditEntry) error
+	AuditLog(limit int) ([]AuditEntry, error)
+
+	Backup(dir string, config BackupConfig, sink BackupSink) error
+	Close() error
+}
+
+var (
+	_ Store = DB{}
+	_ Store = (*MemoryStore)(nil)
+)
+
+// ---------- SQLite -------------
+
+func (db DB) LatestSnapshot(contest string) (ViewPoint, bool, error) {
+	return fetchLatestSnapshot(db, contest)
+}
+
+func (db DB) InsertSnapshot(contest string, ts int64, clicks map[string]int64, views int64) error {
+	return insertSnapshotAt(db, contest, ts, clicks, views)
+}
+
+func (db DB) History(contest string, q HistoryQuery) ([]ViewPoint, error) {
+	return fetchHistory(db, contest, q)
+}
+
+func (db DB) Compact(config CompactionConfig, now time.Time) (int64, error) {
+	return compactSnapshots(db, config, now)
+}
+
+func (db DB) InsertClickEvents(events []ClickEvent) error {
+	return insertClickEvents(db, events)
+}
+
+func (db DB) ClicksSinceSnapshot(contest string) (map[string]int64, error) {
+	return fetchClicksSinceSnapshot(db, contest)
+}
+
+func (db DB) InsertContest(contest *Contest) error {
+	return insertContest(db, contest)
+}
+
+func (db DB) Contests() ([]storedContest, error) {
+	return fetchContests(db)
+}
+
+func (db DB) CountContestsBy(creator string, since int64) (int, error) {
+	return countContestsBy(db, creator, since)
+}
+
+func (db DB) UpdateContestActivity(slug string, lastActive int64) error {
+	return updateContestActivity(db, slug, lastActive)
+}
+
+func (db DB) DeleteContest(slug string) error {
+	return deleteContest(db, slug)
+}
+
+func (db DB) InsertMilestone(m Milestone, name, client string) error {
+	return insertMilestone(db, m, name, client)
+}
+
+func (db DB) Milestones(contest string, limit int) ([]RecordedMilestone, error) {
+	return fetchMilestones(db, contest, limit)
+}
+
+func (db DB) ReplicaCounts(contest string) (ReplicaState, error) {
+	return fetchReplicaCounts(db, contest)
+}
+
+func (db DB) SaveReplicaCounts(contest string, state ReplicaState) error {
+	return saveReplicaCounts(db, contest, state)
+}
+
+func (db DB) InsertAudit(entry AuditEntry) error {
+	return insertAudit(db, entry)
+}
+
+func (db DB) AuditLog(limit int) ([]AuditEntry, error) {
+	return fetchAuditLog(db, limit)
+}
+
+func (db DB) Backup(dir string, config BackupConfig, sink BackupSink) error {
+	return takeBackup(db, dir, config, sink)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Both stores must answer every query the same way.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("sqlite", func(t *testing.T) { test(t, newTestDB(t)) })
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryStore()) })
+}
+
+func TestStoreSnapshotsAndHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if _, found, err := store.LatestSnapshot(""); found || err != nil {
+			t.Fatalf("empty store: found %v, err %v", found, err)
+		}
+		for ts := int64(1000); ts < 2000; ts += 10 {
+			if err := store.InsertSnapshot("", ts, map[string]int64{"A": ts - 1000, "B": 1}, ts); err != nil {
+				t.Fatalf("insert %d: %v", ts, err)
+			}
+		}
+		store.InsertSnapshot("other", 1500, map[string]int64{"A": 99}, 1)
+		if err := store.InsertSnapshot("", 1990, nil, 0); err == nil {
+			t.Fatal("a second snapshot at the same ts should fail")
+		}
+
+		latest, found, err := store.LatestSnapshot("")
+		if err != nil || !found || latest.Ts != 1990 || latest.views != 1990 || latest.Clicks["A"] != 990 {
+			t.Fatalf("latest: got %+v, found %v, err %v", latest, found, err)
+		}
+
+		all, _ := store.History("", HistoryQuery{})
+		if len(all) != 100 {
+			t.Fatalf("all history: want 100 points, got %d", len(all))
+		}
+		stepped, _ := store.History("", HistoryQuery{From: 1200, To: 1599, Step: 10})
+		var ts []int64
+		for _, p := range stepped {
+			ts = append(ts, p.Ts)
+		}
+		want := []int64{1230, 1270, 1310, 1350, 1390, 1430, 1470, 1510, 1550, 1590}
+		if !reflect.DeepEqual(ts, want) {
+			t.Fatalf("stepped history: want %v, got %v", want, ts)
+		}
+		since, _ := store.History("", HistoryQuery{Since: 1970})
+		if len(since) != 2 || since[0].Ts != 1980 {
+			t.Fatalf("since: got %+v", since)
+		}
+	})
+}
+
+func TestStoreClicksSinceSnapshot(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		store.InsertSnapshot("", 100, map[string]int64{"A": 1}, 1)
+		store.InsertClickEvents([]ClickEvent{
+			{Ts: 100_500, Option: "A"}, // same second as the snapshot, skipped
+			{Ts: 101_000, Option: "A"},
+			{Ts: 102_000, Option: "B"},
+			{Ts: 102_000, Contest: "other", Option: "B"},
+		})
+		missed, err := store.ClicksSinceSnapshot("")
+		if err != nil || !sameCounts(missed, map[string]int64{"A": 1, "B": 1}) {
+			t.Fatalf("missed clicks: got %v, err %v", missed, err)
+		}
+	})
+}
+
+func TestStoreContestsAndMilestones(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		contest := &Contest{Slug: "pets", Title: "Pets", Creator: "c1", CreatedAt: 100,
+			Options: []Option{{ID: "A"}, {ID: "B"}}}
+		if err := store.InsertContest(contest); err != nil {
+			t.Fatalf("insert contest: %v", err)
+		}
+		if err := store.InsertContest(contest); err == nil {
+			t.Fatal("a duplicate slug should fail")
+		}
+		store.UpdateContestActivity("pets", 500)
+		if n, _ := store.CountContestsBy("c1", 100); n != 1 {
+			t.Fatalf("count by creator: want 1, got %d", n)
+		}
+		if n, _ := store.CountContestsBy("c1", 101); n != 0 {
+			t.Fatalf("count since later: want 0, got %d", n)
+		}
+		stored, _ := store.Contests()
+		if len(stored) != 1 || stored[0].lastActive != 500 || len(stored[0].contest.Options) != 2 {
+			t.Fatalf("contests: got %+v", stored)
+		}
+
+		m := Milestone{Contest: "pets", Option: "A", Count: 10, Kind: milestoneKindCount}
+		if err := store.InsertMilestone(m, "ada", "c2"); err != nil {
+			t.Fatalf("insert milestone: %v", err)
+		}
+		if err := store.InsertMilestone(m, "bob", "c3"); err != errMilestoneTaken {
+			t.Fatalf("second claim: want errMilestoneTaken, got %v", err)
+		}
+		store.InsertMilestone(Milestone{Contest: "pets", Option: "A", Count: 20, Kind: milestoneKindCount}, "cy", "c4")
+		recorded, _ := store.Milestones("pets", 1)
+		if len(recorded) != 1 || recorded[0].Count != 20 {
+			t.Fatalf("milestones: got %+v", recorded)
+		}
+
+		store.InsertSnapshot("pets", 100, map[string]int64{"A": 1}, 1)
+		if err := store.DeleteContest("pets"); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		stored, _ = store.Contests()
+		pts, _ := store.History("pets", HistoryQuery{})
+		recorded, _ = store.Milestones("pets", 10)
+		if len(stored) != 0 || len(pts) != 0 || len(recorded) != 0 {
+			t.Fatalf("contest data should be gone: %d contests, %d points, %d milestones", len(stored), len(pts), len(recorded))
+		}
+	})
+}
+
+func TestMemoryStoreCopiesSnapshots(t *testing.T) {
+	store := NewMemoryStore()
+	clicks := map[string]int64{"A": 1}
+	store.InsertSnapshot("", 100, clicks, 1)
+	clicks["A"] = 5
+
+	latest, _, _ := store.LatestSnapshot("")
+	latest.Clicks["A"] = 7
+	if again, _, _ := store.LatestSnapshot(""); again.Clicks["A"] != 1 {
+		t.Fatalf("stored snapshot was modified through a caller's map: %v", again.Clicks)
+	}
+	if moved, err := store.Compact(CompactionConfig{}, time.Now()); moved != 0 || err != nil {
+		t.Fatalf("compact: %d, %v", moved, err)
+	}
+}
+
+func TestStoreReplicaCounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		if state, err := store.ReplicaCounts(""); len(state) != 0 || err != nil {
+			t.Fatalf("empty store: got %v, err %v", state, err)
+		}
+		store.SaveReplicaCounts("", ReplicaState{"a": {"A": 5}, "b": {"A": 2, "B": 1}})
+		store.SaveReplicaCounts("", ReplicaState{"a": {"A": 3}, "b": {"B": 4}})
+		store.SaveReplicaCounts("other", ReplicaState{"a": {"A": 99}})
+
+		state, err := store.ReplicaCounts("")
+		want := ReplicaState{"a": {"A": 5}, "b": {"A": 2, "B": 4}}
+		if err != nil || !reflect.DeepEqual(state, want) {
+			t.Fatalf("want %v, got %v, err %v", want, state, err)
+		}
+	})
+}
+
+func TestStoreAuditLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		for i, action := range []string{"pause", "resume", "adjust"} {
+			store.InsertAudit(AuditEntry{Ts: int64(100 + i), Action: action, Client: "c"})
+		}
+		entries, err := store.AuditLog(2)
+		if err != nil || len(entries) != 2 || entries[0].Action != "adjust" || entries[1].Action != "resume" || entries[0].Ts != 102 {
+			t.Fatalf("want the newest entries first, got %+v, err %v", entries, err)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+func TestEncodeCounterEventMatchesDatastar(t *testing.T) {
+	counters := map[string]int64{"A": 3, "B": 12}
+	rr := httptest.NewRecorder()
+	sse := datastar.NewSSE(rr, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if err := sse.MarshalAndMergeSignals(&Signal{"counters": counters}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(encodeCounterEvent(Signal{"counters": counters})), rr.Body.String(); got != want {
+		t.Fatalf("encoded event differs from the sdk:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestPublishCountersOnlyOnChange(t *testing.T) {
+	app := newTestApp()
+	sub := app.counterStream.Subscribe()
+	defer app.counterStream.Unsubscribe(sub)
+
+	previous := app.publishCounters(nil)
+	<-sub.C
+	previous = app.publishCounters(previous)
+	if len(sub.C) != 0 {
+		t.Fatal("unchanged counters should not be published")
+	}
+	app.clicks.Add("A", 2)
+	app.clicks.Add("B", 1)
+	app.publishCounters(previous)
+
+	if got := string((<-sub.C).sse); !strings.Contains(got, `"counters":{"A":2,"B":1}`) {
+		t.Fatalf("event should carry every counter, got %q", got)
+	}
+}
+
+func TestStreamHandlerForwardsPublishedEvents(t *testing.T) {
+	app := newTestApp()
+	app.clicks.Store("A", 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rr := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		app.streamHandler(rr, httptest.NewRequest(http.MethodGet, "/stream", nil).WithContext(ctx))
+		close(finished)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for app.counterStream.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream never subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	app.clicks.Add("B", 1)
+	app.publishCounters(map[string]int64{"A": 5})
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-finished
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `{"counters":{"A":5,"B":0}}`) {
+		t.Errorf("stream should start with the current counts, got %q", body)
+	}
+	if !strings.Contains(body, `{"counters":{"A":5,"B":1}}`) {
+		t.Errorf("stream should forward published events, got %q", body)
+	}
+}
+
+// ---------------------- benchmarks ----------------------
+
+// The stream benchmarks simulate one interval per iteration with a click
+// every clickEvery intervals, and report the cost per connected client.
+//
+//	go test -run '^$' -bench Stream -benchtime 200x
+const clickEvery = 10
+
+var streamClientCounts = []int{10, 100, 1000}
+
+// BenchmarkStreamPolling is the old /stream: each connection woke on its own
+// ticker, sampled the counters and encoded whatever changed.
+func BenchmarkStreamPolling(b *testing.B) {
+	for _, clients := range streamClientCounts {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			app := newTestApp()
+			ticks := make([]chan struct{}, clients)
+			var polled sync.WaitGroup
+			for i := range ticks {
+				ticks[i] = make(chan struct{})
+				go pollCounters(app, io.Discard, ticks[i], &polled)
+			}
+			defer func() {
+				for _, tick := range ticks {
+					close(tick)
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%clickEvery == 0 {
+					app.clicks.Add("A", 1)
+				}
+				polled.Add(clients)
+				for _, tick := range ticks {
+					tick <- struct{}{}
+				}
+				polled.Wait()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*clients), "ns/client")
+		})
+	}
+}
+
+func pollCounters(app *App, w io.Writer, tick <-chan struct{}, polled *sync.WaitGroup) {
+	previous := make(map[string]int64)
+	for range tick {
+		changed := Signal{}
+		for option, count := range app.clicks.Snapshot() {
+			if previous[option] != count {
+				previous[option] = count
+				changed[option] = count
+			}
+		}
+		if len(changed) > 0 {
+			signals, _ := json.Marshal(Signal{"counters": changed})
+			fmt.Fprintf(w, "event: datastar-merge-signals\nretry: 1000\ndata: signals %s\n\n", signals)
+		}
+		polled.Done()
+	}
+}
+
+// BenchmarkStreamPush is the publisher: one sample per interval, one encoding
+// per change and connections only wake up to write it.
+func BenchmarkStreamPush(b *testing.B) {
+	for _, clients := range streamClientCounts {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			app := newTestApp()
+			var delivered sync.WaitGroup
+			for i := 0; i < clients; i++ {
+				sub := app.counterStream.Subscribe()
+				defer app.counterStream.Unsubscribe(sub)
+				go func() {
+					for event := range sub.C {
+						io.Discard.Write(event.sse)
+						delivered.Done()
+					}
+				}()
+			}
+
+			var previous map[string]int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%clickEvery == 0 {
+					app.clicks.Add("A", 1)
+					delivered.Add(clients)
+				}
+				previous = app.publishCounters(previous)
+				delivered.Wait()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*clients), "ns/client")
+		})
+	}
+}
@@ -0,0 +1,17 @@
+#!/bin/sh
+# Downloads the pinned front-end libraries and fonts into assets/vendor so
+# they are embedded in the binary and no page needs a CDN. Run it through
+# `go generate` and commit the files it writes.
+set -eu
+cd "$(dirname "$0")/assets/vendor"
+
+fetch() {
+	echo "vendoring $1"
+	curl -fsSLo "$1" "$2"
+}
+
+fetch datastar-1.0.0-beta.11.js https://cdn.jsdelivr.net/gh/starfederation/datastar@v1.0.0-beta.11/bundles/datastar.js
+fetch chart-4.4.0.umd.min.js https://cdn.jsdelivr.net/npm/chart.js@4.4.0/dist/chart.umd.min.js
+fetch chartjs-adapter-date-fns-3.js https://cdn.jsdelivr.net/npm/chartjs-adapter-date-fns@3.0.0/dist/chartjs-adapter-date-fns.bundle.min.js
+fetch nunito-latin-400-normal.woff2 https://cdn.jsdelivr.net/npm/@fontsource/nunito@5.0.19/files/nunito-latin-400-normal.woff2
+fetch nunito-latin-600-normal.woff2 https://cdn.jsdelivr.net/npm/@fontsource/nunito@5.0.19/files/nunito-latin-600-normal.woff2
@@ -0,0 +1,16 @@
+//go:build vendored
+
+package main
+
+import "embed"
+
+// Release builds are made with -tags vendored, which refuses to compile
+// until vendor.sh has fetched every file below, instead of quietly loading
+// them from a CDN. Keep the list in step with vendor.sh.
+//
+//go:embed assets/vendor/datastar-1.0.0-beta.11.js
+//go:embed assets/vendor/chart-4.4.0.umd.min.js
+//go:embed assets/vendor/chartjs-adapter-date-fns-3.js
+//go:embed assets/vendor/nunito-latin-400-normal.woff2
+//go:embed assets/vendor/nunito-latin-600-normal.woff2
+var vendoredFiles embed.FS
@@ -0,0 +1,25 @@
+//go:build vendored
+
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVendoredBuildLoadsNothingFromCDNs(t *testing.T) {
+	entries, err := fs.ReadDir(vendoredFiles, "assets/vendor")
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("vendored files: %v", err)
+	}
+
+	app := newTestApp()
+	rr := httptest.NewRecorder()
+	app.homeHandler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if page := rr.Body.String(); strings.Contains(page, "cdn.jsdelivr.net") {
+		t.Fatalf("the home page still loads a script from a CDN:\n%s", page)
+	}
+}